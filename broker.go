@@ -1,11 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
@@ -16,14 +25,36 @@ var statusTemplate string
 type Broker struct {
 	listenAddr string
 
-	state *State
+	mu         sync.RWMutex
+	heartbeat  Heartbeat
+	queue      QueueConfig
+	tlsConfig  *tls.Config
+	fileLimit  int64
+	mailbox    MailboxLimits
+	draining   map[*Endpoint]struct{}
+	streams    map[string]execStream
+	nextStream uint64
+	links      map[streamEnd]streamEnd
+	sockets    map[*Emitter]*websocket.Conn
+
+	state  *State
+	topics *Topics
 }
 
 func NewBroker(addr string) *Broker {
 	var b Broker
 	b.listenAddr = addr
+	b.heartbeat = DefaultHeartbeat()
+	b.queue = DefaultQueueConfig()
+	b.fileLimit = DefaultFileLimit
+	b.mailbox = DefaultMailboxLimits()
 
 	b.state = NewState()
+	b.topics = NewTopics()
+	b.streams = make(map[string]execStream)
+	b.links = make(map[streamEnd]streamEnd)
+	b.sockets = make(map[*Emitter]*websocket.Conn)
+	b.draining = make(map[*Endpoint]struct{})
 
 	return &b
 }
@@ -32,18 +63,214 @@ func (b *Broker) State() *State {
 	return b.state
 }
 
+func (b *Broker) Topics() *Topics {
+	return b.topics
+}
+
+func (b *Broker) Heartbeat() Heartbeat {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.heartbeat
+}
+
+// SetHeartbeat applies to sessions established after the call.
+func (b *Broker) SetHeartbeat(heartbeat Heartbeat) error {
+	if err := heartbeat.Valid(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.heartbeat = heartbeat
+	return nil
+}
+
+func (b *Broker) QueueConfig() QueueConfig {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.queue
+}
+
+// SetQueueConfig applies to sessions established after the call.
+func (b *Broker) SetQueueConfig(config QueueConfig) error {
+	if err := config.Valid(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queue = config
+	return nil
+}
+
+// QueueStats reports the outbound queue of every session, ordered by address.
+func (b *Broker) QueueStats() []QueueStats {
+	endpoints := make(map[*Emitter]string)
+	for _, endpoint := range b.State().AllEndpoints() {
+		if emitter := endpoint.Emitter(); emitter != nil {
+			endpoints[emitter] = endpoint.Name()
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var ret []QueueStats
+	for emitter, ws := range b.sockets {
+		stats := emitter.Stats()
+		stats.Session = ws.Request().RemoteAddr
+		stats.Endpoint = endpoints[emitter]
+		ret = append(ret, stats)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Session < ret[j].Session
+	})
+	return ret
+}
+
+func (b *Broker) FileLimit() int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.fileLimit
+}
+
+// SetFileLimit caps the size of files transferred through the broker.
+func (b *Broker) SetFileLimit(limit int64) error {
+	if limit <= 0 {
+		return errors.New("File limit must be positive")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fileLimit = limit
+	return nil
+}
+
+func (b *Broker) MailboxLimits() MailboxLimits {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.mailbox
+}
+
+// SetMailboxLimits applies to messages queued after the call.
+func (b *Broker) SetMailboxLimits(limits MailboxLimits) error {
+	if err := limits.Valid(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mailbox = limits
+	return nil
+}
+
+func (b *Broker) EnableTLS(certFile string, keyFile string) error {
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	b.tlsConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	log.Printf("Broker: Serving TLS with %v\n", certFile)
+
+	return nil
+}
+
+// EnableSelfSignedTLS generates a development certificate for the listen
+// address. Given paths are only written when no files exist yet, so the same
+// certificate can be handed to instances via 'connect --ca'.
+func (b *Broker) EnableSelfSignedTLS(certFile string, keyFile string) error {
+	host, _, err := net.SplitHostPort(b.listenAddr)
+	if err != nil {
+		return err
+	}
+
+	if len(certFile) > 0 && len(keyFile) > 0 {
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			certPEM, keyPEM, err := GenerateSelfSigned(host)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+				return err
+			}
+			log.Printf("Broker: Generated self-signed certificate %v\n", certFile)
+		}
+		return b.EnableTLS(certFile, keyFile)
+	}
+
+	certPEM, keyPEM, err := GenerateSelfSigned(host)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	b.tlsConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	log.Printf("Broker: Serving TLS with ephemeral self-signed certificate (sha256 %v)\n", certFingerprint(&cert))
+
+	return nil
+}
+
+// EnableClientAuth verifies client certificates against the CAs in caFile.
+// Sessions presenting a certificate are authenticated as the user it names
+// and may only identify as its hostname, see certIdentity.
+func (b *Broker) EnableClientAuth(caFile string, require bool) error {
+	if b.tlsConfig == nil {
+		return errors.New("Client certificates require TLS")
+	}
+	pool, err := LoadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+
+	b.tlsConfig.ClientCAs = pool
+	if require {
+		b.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		b.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	log.Printf("Broker: Verifying client certificates against %v (required: %v)\n", caFile, require)
+
+	return nil
+}
+
+func (b *Broker) Persist(path string) error {
+	st, err := OpenStore(path)
+	if err != nil {
+		return err
+	}
+	if err := b.State().SetStore(st); err != nil {
+		return err
+	}
+
+	log.Printf("Broker: Persisting state to %v\n", st.Path())
+
+	return nil
+}
+
 func (b *Broker) HandleStatus() string {
 	t, _ := template.New("status").Parse(statusTemplate)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
-			t.Execute(w, b.State())
+			t.Execute(w, b.State().Snapshot())
 		} else {
 			http.Error(w, "resource unavailable", 500)
 		}
 	})
 
-	url := fmt.Sprintf("http://%v/", b.listenAddr)
+	scheme := "http"
+	if b.tlsConfig != nil {
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%v://%v/", scheme, b.listenAddr)
 
 	log.Printf("Broker: Enabled statuspage on %v\n", url)
 
@@ -54,16 +281,56 @@ func (b *Broker) ListenAndServe() (err error) {
 	http.Handle("/broker", websocket.Handler(func(ws *websocket.Conn) {
 		var user *User
 		fullLogin := false
+		boundHost := ""
 		var endpoint *Endpoint
-		cRecv := make(chan Message)
-		cSend := make(chan Message)
-		emitter := NewEmitter(cSend, cRecv)
+		// identity pinned by a verified client certificate, survives deauth
+		var certUser *User
+		certHost := ""
+		if cs := ws.Request().TLS; cs != nil && len(cs.VerifiedChains) > 0 {
+			name, host, err := certIdentity(cs.PeerCertificates[0])
+			if err == nil {
+				certUser, err = b.State().GetUser(name)
+			}
+			if err != nil {
+				log.Printf("Broker: Rejecting client certificate (%v)\n", err)
+				ws.Close()
+				return
+			}
+			user, boundHost = certUser, host
+			certHost = host
+			log.Printf("Broker: User %v authenticated by client certificate for %v\n", user.Name(), certHost)
+		}
+		peer, err := welcome(ws)
+		if err != nil {
+			log.Printf("Broker: Rejecting %v (%v)\n", ws.Request().RemoteAddr, err)
+			ws.Close()
+			return
+		}
+		log.Printf("Broker: Session %v speaks %v\n", ws.Request().RemoteAddr, peer)
+
+		emitter := NewEmitter(b.QueueConfig()).SetPeer(peer).OnOverflow(func() {
+			log.Printf("Broker: Disconnecting slow consumer %v\n", ws.Request().RemoteAddr)
+			// the writer is stuck on the socket, so would be a close frame
+			ws.SetDeadline(time.Now())
+			ws.Close()
+		})
+		b.mu.Lock()
+		b.sockets[emitter] = ws
+		b.mu.Unlock()
+		go emitter.Run(func(msg Message) error {
+			return websocket.JSON.Send(ws, msg)
+		})
+
+		if certUser != nil {
+			b.State().PushState(emitter, user)
+		}
+
+		quit := make(chan struct{})
 		go func() {
-			for {
-				err := websocket.JSON.Send(ws, <-cSend)
-				if err != nil {
-					break
-				}
+			heartbeat := b.Heartbeat()
+			if err := heartbeat.Run(quit, emitter.Execute, func(rtt time.Duration) { emitter.SetLatency(rtt) }); err != nil {
+				log.Printf("Broker: Evicting silent session (%v)\n", err)
+				ws.Close()
 			}
 		}()
 
@@ -71,16 +338,22 @@ func (b *Broker) ListenAndServe() (err error) {
 			var msg Message
 			err := websocket.JSON.Receive(ws, &msg)
 			if err != nil {
+				close(quit)
 				log.Printf("Broker: Lost connection (%v)\n", err)
 				if endpoint != nil {
 					log.Printf("Broker: Endpoint %v (%v) disconnected\n", endpoint.Name(), endpoint.Owner().Name())
-					if endpoint.Connected() {
-						endpoint.Disconnect()
+					if endpoint.DisconnectEmitter(emitter) {
+						brc := NewMessage(MessageEventEndpointOffline)
+						brc.Encode(EventPayload{Name: endpoint.Name()})
+						b.State().Broadcast(brc)
 					}
-					brc := NewMessage(MessageEventEndpointOffline)
-					brc.Data["name"] = endpoint.Name()
-					b.State().Broadcast(brc)
 				}
+				b.Topics().Drop(emitter)
+				b.closeStreams(emitter)
+				b.mu.Lock()
+				delete(b.sockets, emitter)
+				b.mu.Unlock()
+				emitter.Close()
 				break
 			}
 
@@ -88,122 +361,305 @@ func (b *Broker) ListenAndServe() (err error) {
 				msg.Data = make(map[string]string)
 			}
 			if msg.Reply {
-				cRecv <- msg
+				if !emitter.Deliver(msg) {
+					log.Printf("Broker: Dropping unsolicited reply %v\n", msg.ID)
+				}
 				continue
 			}
 			msg.Reply = true
 
+			if msg.Type == MessagePing {
+				msg.Success = true
+				emitter.Send(msg)
+				continue
+			}
+
 			if msg.Type != MessageLogin && msg.Type != MessageAuth && user == nil {
-				msg.Data["message"] = "Method not allowed"
-				websocket.JSON.Send(ws, msg)
+				msg.Failf(CodeUnauthorized, "Method not allowed")
+				emitter.Send(msg)
+				continue
+			}
+
+			payload, err := msg.Payload()
+			if err != nil {
+				log.Printf("Broker: Rejecting malformed message type %v (%v)\n", msg.Type, err)
+				// relayed traffic goes unanswered
+				if msg.Type != MessageExecOutput && (!isStreamMessage(msg.Type) || msg.Type == MessageStreamOpen) {
+					msg.Fail(err)
+					emitter.Send(msg)
+				}
 				continue
 			}
 
 			switch msg.Type {
 			case MessageLogin:
-				log.Printf("Broker: Login attempt for %v\n", msg.Data["username"])
-				if u, err := b.State().GetUser(msg.Data["username"]); err == nil {
-					if u.CheckPassword(msg.Data["password"]) {
+				req := payload.(*LoginPayload)
+				log.Printf("Broker: Login attempt for %v\n", req.Username)
+				if u, err := b.State().GetUser(req.Username); err == nil {
+					if certUser != nil && u != certUser {
+						msg.Failf(CodeForbidden, "Session is bound to client certificate of %v", certUser.Name())
+					} else if b.State().Authenticate(u, req.Password) {
 						user = u
 						fullLogin = true
+						boundHost = certHost
 						log.Printf("Broker: User %v logged in\n", user.Name())
 						msg.Success = true
 					} else {
-						msg.Data["message"] = "Invalid password"
+						msg.Failf(CodeUnauthorized, "Invalid password")
 					}
 				} else {
-					msg.Data["message"] = "User does not exist"
+					msg.Failf(CodeUnauthorized, "User does not exist")
+				}
+				emitter.Send(msg)
+				if msg.Success {
+					b.State().PushState(emitter, user)
 				}
-				websocket.JSON.Send(ws, msg)
-				b.State().PushState(emitter)
 			case MessageLogoff:
 				fullLogin = false
 				msg.Success = true
-				websocket.JSON.Send(ws, msg)
+				emitter.Send(msg)
 			case MessageAuth:
+				req := payload.(*AuthPayload)
 				for _, u := range b.State().Users() {
-					if u.CheckToken(msg.Data["token"]) {
+					if t, ok := u.CheckToken(req.Token); ok {
+						if certUser != nil && u != certUser {
+							break
+						}
 						user = u
+						boundHost = t.Endpoint
+						if len(certHost) > 0 {
+							boundHost = certHost
+						}
+						b.State().UseToken(u, t)
 						msg.Success = true
 						break
 					}
 				}
 				if !msg.Success {
-					msg.Data["message"] = "Invalid token"
+					msg.Failf(CodeUnauthorized, "Invalid token")
+				}
+				emitter.Send(msg)
+				if msg.Success {
+					b.State().PushState(emitter, user)
 				}
-				websocket.JSON.Send(ws, msg)
-				b.State().PushState(emitter)
 			case MessageDeauth:
 				fullLogin = false
-				user = nil
+				user = certUser
+				boundHost = certHost
 				if endpoint != nil {
-					if endpoint.Connected() {
-						endpoint.Disconnect()
+					if endpoint.DisconnectEmitter(emitter) {
+						brc := NewMessage(MessageEventEndpointOffline)
+						brc.Encode(EventPayload{Name: endpoint.Name()})
+						b.State().Broadcast(brc)
 					}
-					brc := NewMessage(MessageEventEndpointOffline)
-					brc.Data["name"] = endpoint.Name()
-					b.State().Broadcast(brc)
 					endpoint = nil
+					b.Topics().Drop(emitter)
+					b.closeStreams(emitter)
 				}
 				msg.Success = true
-				websocket.JSON.Send(ws, msg)
+				emitter.Send(msg)
 			case MessageIdentify:
-				if e, err := b.State().GetEndpoint(msg.Data["hostname"]); err == nil {
+				req := payload.(*IdentifyPayload)
+				if len(boundHost) > 0 && req.Hostname != boundHost {
+					if len(certHost) > 0 {
+						msg.Failf(CodeForbidden, "Client certificate is bound to endpoint %v", boundHost)
+					} else {
+						msg.Failf(CodeForbidden, "Token is bound to endpoint %v", boundHost)
+					}
+					emitter.Send(msg)
+					break
+				}
+				if e, err := b.State().GetEndpoint(req.Hostname); err == nil {
 					if e.Owner() == user {
-						e.Disconnect()
-						if endpoint != nil && endpoint.Connected() {
-							endpoint.Disconnect()
+						if endpoint != nil {
+							endpoint.DisconnectEmitter(emitter)
 						}
+						// whichever session still holds e is taken over
+						e.Disconnect()
 						endpoint = e
 						msg.Success = true
 					} else {
-						msg.Data["message"] = "User does not own this hostname"
+						msg.Failf(CodeNotOwner, "User does not own this hostname")
 					}
 				} else {
-					if e, err = b.State().NewEndpoint(msg.Data["hostname"], user); err == nil {
-						if endpoint != nil && endpoint.Connected() {
-							endpoint.Disconnect()
+					if e, err = b.State().NewEndpoint(req.Hostname, user); err == nil {
+						if endpoint != nil {
+							endpoint.DisconnectEmitter(emitter)
 						}
 						endpoint = e
 						msg.Success = true
 					} else {
-						msg.Data["message"] = fmt.Sprintf("%v", err)
+						msg.Fail(err)
 					}
 				}
 				if msg.Success {
+					// subscriptions belong to the endpoint this session was before
+					b.Topics().Drop(emitter)
+					b.closeStreams(emitter)
 					log.Printf("Broker: Endpoint %v just identified\n", endpoint.Name())
 					endpoint.Connect(emitter)
 					emitter.Send(b.State().NotifyNewEndpoint(endpoint.Name(), endpoint.Owner().Name()))
 					brc := NewMessage(MessageEventEndpointOnline)
-					brc.Data["name"] = endpoint.Name()
+					brc.Encode(EventPayload{Name: endpoint.Name()})
 					b.State().Broadcast(brc)
 				}
-				websocket.JSON.Send(ws, msg)
+				emitter.Send(msg)
+				if msg.Success && b.State().HasMail(endpoint) {
+					go b.drain(endpoint)
+				}
 			case MessageNewAuthToken:
 				if !fullLogin {
-					msg.Data["message"] = "Method requires full login"
-					websocket.JSON.Send(ws, msg)
+					msg.Fail(ErrFullLogin)
+					emitter.Send(msg)
 					break
 				}
-				msg.Data["token"] = user.NewToken()
-				msg.Success = true
-				websocket.JSON.Send(ws, msg)
+				req := payload.(*NewAuthTokenPayload)
+				if token, t, err := b.State().NewToken(user, req.Label, req.TTL, req.Endpoint); err == nil {
+					msg.Data["token"] = token
+					msg.Data["id"] = t.ID
+					msg.Success = true
+				} else {
+					msg.Fail(err)
+				}
+				emitter.Send(msg)
 			case MessageDeleteAuthToken:
 				if !fullLogin {
-					msg.Data["message"] = "Method requires full login"
-					websocket.JSON.Send(ws, msg)
+					msg.Fail(ErrFullLogin)
+					emitter.Send(msg)
 					break
 				}
-				user.RemoveToken(msg.Data["token"])
+				if t, err := user.GetToken(tokenID(payload.(*DeleteAuthTokenPayload).Token)); err == nil {
+					b.State().RemoveToken(user, t.ID)
+					msg.Success = true
+				} else {
+					msg.Fail(err)
+				}
+				emitter.Send(msg)
+			case MessageListAuthTokens:
+				if !fullLogin {
+					msg.Fail(ErrFullLogin)
+					emitter.Send(msg)
+					break
+				}
+				var tokens []Token
+				for _, t := range user.Tokens() {
+					tokens = append(tokens, t.Public())
+				}
+				raw, _ := json.Marshal(tokens)
+				msg.Data["tokens"] = string(raw)
 				msg.Success = true
-				websocket.JSON.Send(ws, msg)
+				emitter.Send(msg)
+			case MessageDirect:
+				if endpoint == nil {
+					msg.Fail(ErrNotIdentified)
+					emitter.Send(msg)
+					break
+				}
+				go b.route(emitter, endpoint, msg, payload.(*DirectPayload))
+			case MessageGroupSend:
+				if endpoint == nil {
+					msg.Fail(ErrNotIdentified)
+					emitter.Send(msg)
+					break
+				}
+				go b.routeGroup(emitter, endpoint, msg, payload.(*GroupSendPayload))
+			case MessageSubscribe, MessageUnsubscribe:
+				if endpoint == nil {
+					msg.Fail(ErrNotIdentified)
+					emitter.Send(msg)
+					break
+				}
+				req := payload.(*SubscribePayload)
+				sub := Subscription{Endpoint: endpoint, Pattern: req.Topic, Group: req.Group}
+				if len(sub.Group) > 0 && !b.State().Visibility(endpoint.Owner()).Group(sub.Group) {
+					msg.Failf(CodeNotFound, "Group not found")
+				} else if msg.Type == MessageUnsubscribe {
+					if b.Topics().Unsubscribe(emitter, sub) {
+						msg.Success = true
+					} else {
+						msg.Failf(CodeNotFound, "Not subscribed")
+					}
+				} else if err := b.Topics().Subscribe(emitter, sub); err != nil {
+					msg.Fail(err)
+				} else {
+					msg.Success = true
+				}
+				emitter.Send(msg)
+			case MessagePublish:
+				if endpoint == nil {
+					msg.Fail(ErrNotIdentified)
+					emitter.Send(msg)
+					break
+				}
+				req := payload.(*PublishPayload)
+				if err := validTopic(req.Topic, false); err != nil {
+					msg.Fail(err)
+					emitter.Send(msg)
+					break
+				}
+				go b.publish(emitter, endpoint, msg, req)
+			case MessageExec:
+				if endpoint == nil {
+					msg.Fail(ErrNotIdentified)
+					emitter.Send(msg)
+					break
+				}
+				go b.routeExec(emitter, endpoint, msg, payload.(*ExecPayload))
+			case MessageExecOutput:
+				b.relayExecOutput(emitter, payload.(*ExecOutputPayload))
+			case MessageStreamOpen:
+				if endpoint == nil {
+					msg.Fail(ErrNotIdentified)
+					emitter.Send(msg)
+					break
+				}
+				go b.routeStream(emitter, endpoint, msg, payload.(*StreamOpenPayload))
+			case MessageStreamData, MessageStreamWindow, MessageStreamClose, MessageStreamControl:
+				b.relayStream(emitter, msg)
+			case MessageFileStat, MessageFileWrite, MessageFileRead, MessageFileCommit:
+				if endpoint == nil {
+					msg.Fail(ErrNotIdentified)
+					emitter.Send(msg)
+					break
+				}
+				go b.routeFile(emitter, endpoint, msg, payload)
+			case MessageListGroupEndpoints:
+				group, err := b.State().GetGroup(payload.(*ListGroupEndpointsPayload).Group)
+				if err != nil || !b.State().Visibility(user).Group(group.Name()) {
+					msg.Failf(CodeNotFound, "Group not found")
+					emitter.Send(msg)
+					break
+				}
+				var members []GroupEndpoint
+				for _, e := range b.State().ExpandGroup(group) {
+					members = append(members, GroupEndpoint{Name: e.Name(), Owner: e.Owner().Name(), Online: e.Online()})
+				}
+				sort.Slice(members, func(i, j int) bool {
+					return members[i].Name < members[j].Name
+				})
+				raw, _ := json.Marshal(members)
+				msg.Data["endpoints"] = string(raw)
+				msg.Success = true
+				emitter.Send(msg)
 			default:
 				log.Printf("Broker: Unhandled event: %v\n", msg)
+				msg.Failf(CodeUnsupported, "Unknown message type %v", msg.Type)
+				emitter.Send(msg)
 			}
 		}
 	}))
 
+	server := &http.Server{Addr: b.listenAddr, TLSConfig: b.tlsConfig}
+	if b.tlsConfig != nil {
+		// websocket upgrades hijack the connection, which HTTP/2 does not allow
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
 	log.Printf("Broker: Listening on %v\n", b.listenAddr)
-	log.Fatal(http.ListenAndServe(b.listenAddr, nil))
+	if b.tlsConfig != nil {
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	} else {
+		log.Fatal(server.ListenAndServe())
+	}
 	return
 }
@@ -1,33 +1,222 @@
 package main
 
+import (
+	"context"
+	"sync"
+	"time"
+)
+
 type Emitter struct {
-	send    chan Message
-	receive chan Message
+	send     chan Message
+	pending  *Pending
+	config   QueueConfig
+	peer     Hello
+	overflow func()
+	done     chan struct{}
+	once     sync.Once
+	dropOnce sync.Once
+
+	mu        sync.RWMutex
+	latency   time.Duration
+	highWater int
+	sent      uint64
+	dropped   uint64
 }
 
-func NewEmitter(send chan Message, receive chan Message) *Emitter {
+func NewEmitter(config QueueConfig) *Emitter {
 	var e Emitter
 
-	e.send = send
-	e.receive = receive
+	e.send = make(chan Message, config.Depth)
+	e.pending = NewPending()
+	e.config = config
+	e.done = make(chan struct{})
 
 	return &e
 }
 
+// SetPeer records the hello of the session, only messages of features it
+// advertised are sent afterwards.
+func (e *Emitter) SetPeer(peer Hello) *Emitter {
+	e.peer = peer
+	return e
+}
+
+func (e *Emitter) Peer() Hello {
+	return e.peer
+}
+
+// OnOverflow registers what to do with the session once its queue overflows
+// under QueueDisconnect, it is called at most once.
+func (e *Emitter) OnOverflow(handler func()) *Emitter {
+	e.overflow = handler
+	return e
+}
+
 func (e *Emitter) Close() {
-	//close(e.send)
-	close(e.receive)
+	e.once.Do(func() {
+		close(e.done)
+	})
+	e.pending.Close()
 }
 
-func (e *Emitter) Send(msg Message) {
-	e.send <- msg
+// Run hands queued messages to write until it fails or the emitter is closed.
+func (e *Emitter) Run(write func(Message) error) {
+	for {
+		select {
+		case msg := <-e.send:
+			if err := write(msg); err != nil {
+				return
+			}
+			e.mu.Lock()
+			e.sent++
+			e.mu.Unlock()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// Send queues msg according to the queue policy, which may wait for room.
+func (e *Emitter) Send(msg Message) error {
+	return e.enqueue(msg, true)
+}
+
+// Post queues msg without ever waiting, for messages fanned out to many
+// sessions. A full queue under QueueBlock loses msg instead.
+func (e *Emitter) Post(msg Message) {
+	e.enqueue(msg, false)
+}
+
+func (e *Emitter) enqueue(msg Message, wait bool) error {
+	if err := e.peer.Allows(msg); err != nil {
+		return err
+	}
+
+	select {
+	case <-e.done:
+		return ErrConnectionLost
+	case e.send <- msg:
+		e.queued()
+		return nil
+	default:
+	}
+
+	switch e.config.Policy {
+	case QueueDropOldest:
+		for {
+			select {
+			case <-e.send:
+				e.drop()
+			default:
+			}
+			select {
+			case <-e.done:
+				return ErrConnectionLost
+			case e.send <- msg:
+				e.queued()
+				return nil
+			default:
+			}
+		}
+	case QueueDisconnect:
+		e.drop()
+		e.dropOnce.Do(func() {
+			if e.overflow != nil {
+				go e.overflow()
+			}
+		})
+		return ErrQueueFull
+	}
+
+	if wait {
+		timer := time.NewTimer(e.config.Timeout)
+		defer timer.Stop()
+		select {
+		case <-e.done:
+			return ErrConnectionLost
+		case e.send <- msg:
+			e.queued()
+			return nil
+		case <-timer.C:
+		}
+	}
+	e.drop()
+	return ErrQueueFull
+}
+
+func (e *Emitter) queued() {
+	depth := len(e.send)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if depth > e.highWater {
+		e.highWater = depth
+	}
+}
+
+func (e *Emitter) drop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dropped++
+}
+
+func (e *Emitter) Stats() QueueStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return QueueStats{
+		Policy:    e.config.Policy,
+		Depth:     len(e.send),
+		Capacity:  cap(e.send),
+		HighWater: e.highWater,
+		Sent:      e.sent,
+		Dropped:   e.dropped,
+	}
+}
+
+// Deliver hands a reply received from the peer to the matching Execute call.
+func (e *Emitter) Deliver(msg Message) bool {
+	return e.pending.Resolve(msg)
+}
+
+// Execute waits for room in the queue regardless of the policy, bounded by
+// ctx, since its caller waits for the reply anyway.
+func (e *Emitter) Execute(ctx context.Context, msg Message) (Message, error) {
+	if err := e.peer.Allows(msg); err != nil {
+		return msg, err
+	}
+
+	reply := e.pending.Register(&msg)
+	select {
+	case e.send <- msg:
+		e.queued()
+	case <-e.done:
+		e.pending.Cancel(msg.ID)
+		return msg, &RequestError{msg.Type, ErrConnectionLost}
+	case <-ctx.Done():
+		e.pending.Cancel(msg.ID)
+		return msg, &RequestError{msg.Type, contextError(ctx)}
+	}
+
+	select {
+	case ret, ok := <-reply:
+		if !ok {
+			return msg, &RequestError{msg.Type, ErrConnectionLost}
+		}
+		return ret, nil
+	case <-ctx.Done():
+		e.pending.Cancel(msg.ID)
+		return msg, &RequestError{msg.Type, contextError(ctx)}
+	}
 }
 
-func (e *Emitter) Receive() Message {
-	return <-e.receive
+func (e *Emitter) Latency() time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.latency
 }
 
-func (e *Emitter) Execute(msg Message) Message {
-	e.Send(msg)
-	return e.Receive()
+func (e *Emitter) SetLatency(latency time.Duration) *Emitter {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.latency = latency
+	return e
 }
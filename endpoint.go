@@ -2,13 +2,17 @@ package main
 
 import (
 	"log"
+	"sync"
+	"time"
 )
 
 type Endpoint struct {
 	Entity
 
+	mu           sync.RWMutex
 	emitter      *Emitter
 	staticOnline bool
+	mail         []Mail
 }
 
 func NewEndpoint(name string) *Endpoint {
@@ -20,28 +24,51 @@ func NewEndpoint(name string) *Endpoint {
 }
 
 func (e *Endpoint) Online() bool {
-	return e.Connected() || e.staticOnline
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.emitter != nil || e.staticOnline
 }
 
 func (e *Endpoint) SetStaticOnline(status bool) *Endpoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.staticOnline = status
 	return e
 }
 
 func (e *Endpoint) Disconnect() *Endpoint {
-	if e.Connected() {
-		e.Emitter().Close()
-	}
+	e.mu.Lock()
+	emitter := e.emitter
 	e.emitter = nil
+	e.mu.Unlock()
+
+	if emitter != nil {
+		emitter.Close()
+	}
 
 	return e
 }
 
+// DisconnectEmitter detaches emitter if it is still the one connected and
+// reports whether it was. A session uses it so it never tears down a newer
+// session that took the endpoint over; closing emitter is left to it.
+func (e *Endpoint) DisconnectEmitter(emitter *Emitter) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.emitter == nil || e.emitter != emitter {
+		return false
+	}
+	e.emitter = nil
+	return true
+}
+
 func (e *Endpoint) Connected() bool {
 	return e.Emitter() != nil
 }
 
 func (e *Endpoint) Connect(emitter *Emitter) *Endpoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if e.emitter != nil {
 		log.Printf("Endpoint %v is already connected. FIXME\n", e.Name())
 	} else {
@@ -51,9 +78,19 @@ func (e *Endpoint) Connect(emitter *Emitter) *Endpoint {
 }
 
 func (e *Endpoint) Emitter() *Emitter {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	return e.emitter
 }
 
+// Latency is the last measured heartbeat round trip, zero while disconnected.
+func (e *Endpoint) Latency() time.Duration {
+	if emitter := e.Emitter(); emitter != nil {
+		return emitter.Latency()
+	}
+	return 0
+}
+
 func (e *Endpoint) SetOwner(owner *User) *Endpoint {
 	if e.Owner() != nil {
 		e.Owner().Group().RemoveEndpoint(e)
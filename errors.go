@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	ErrTimeout        = errors.New("Request timed out")
+	ErrCanceled       = errors.New("Request canceled")
+	ErrConnectionLost = errors.New("Connection lost")
+)
+
+// A RequestError reports why a request never received its reply, use
+// errors.Is with ErrTimeout, ErrCanceled or ErrConnectionLost to tell apart.
+type RequestError struct {
+	Type int
+	Err  error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Request %v: %v", e.Type, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ErrCanceled
+}
+
+// Every failed reply carries one of these codes in Data["code"]. They keep
+// their meaning across versions, Data["message"] is for humans.
+const (
+	CodeFailed         = "failed"
+	CodeUnauthorized   = "unauthorized"
+	CodeFullLogin      = "full_login_required"
+	CodeNotIdentified  = "not_identified"
+	CodeForbidden      = "forbidden"
+	CodeNotFound       = "not_found"
+	CodeNameInUse      = "name_in_use"
+	CodeNotOwner       = "not_owner"
+	CodeInvalid        = "invalid"
+	CodeOffline        = "offline"
+	CodeLimit          = "limit_exceeded"
+	CodeRefused        = "refused"
+	CodeTimeout        = "timeout"
+	CodeDeliveryFailed = "delivery_failed"
+	CodeUnsupported    = "unsupported"
+	CodeHandshake      = "handshake"
+)
+
+var (
+	ErrFailed         = errors.New("Request failed")
+	ErrUnauthorized   = errors.New("Unauthorized")
+	ErrFullLogin      = errors.New("Method requires full login")
+	ErrNotIdentified  = errors.New("Method requires identified endpoint")
+	ErrForbidden      = errors.New("Permission denied")
+	ErrNotFound       = errors.New("Not found")
+	ErrNameInUse      = errors.New("Name in use")
+	ErrNotOwner       = errors.New("Not the owner")
+	ErrInvalid        = errors.New("Invalid request")
+	ErrOffline        = errors.New("Endpoint is offline")
+	ErrLimit          = errors.New("Limit exceeded")
+	ErrRefused        = errors.New("Refused by endpoint")
+	ErrDeliveryFailed = errors.New("Delivery failed")
+	ErrUnsupported    = errors.New("Not supported")
+)
+
+var codeErrors = map[string]error{
+	CodeFailed:         ErrFailed,
+	CodeUnauthorized:   ErrUnauthorized,
+	CodeFullLogin:      ErrFullLogin,
+	CodeNotIdentified:  ErrNotIdentified,
+	CodeForbidden:      ErrForbidden,
+	CodeNotFound:       ErrNotFound,
+	CodeNameInUse:      ErrNameInUse,
+	CodeNotOwner:       ErrNotOwner,
+	CodeInvalid:        ErrInvalid,
+	CodeOffline:        ErrOffline,
+	CodeLimit:          ErrLimit,
+	CodeRefused:        ErrRefused,
+	CodeTimeout:        ErrTimeout,
+	CodeDeliveryFailed: ErrDeliveryFailed,
+	CodeUnsupported:    ErrUnsupported,
+	CodeHandshake:      ErrHandshake,
+}
+
+// A ProtocolError is a failure as reported in a reply. It unwraps to the
+// error of its code, so errors.Is(err, ErrNameInUse) and the like work.
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return codeErrors[e.Code]
+}
+
+// errorCode finds the code to report err with, fallback if it has none.
+func errorCode(err error, fallback string) string {
+	var coded *ProtocolError
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	for code, target := range codeErrors {
+		if errors.Is(err, target) {
+			return code
+		}
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return CodeNotFound
+	case errors.Is(err, os.ErrPermission):
+		return CodeForbidden
+	}
+	return fallback
+}
+
+// deliveryFailed reports a request the broker could not get answered by the
+// endpoint it was forwarded to.
+func deliveryFailed(err error) error {
+	return &ProtocolError{errorCode(err, CodeDeliveryFailed), fmt.Sprintf("Delivery failed: %v", err)}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ExecTimeoutMax caps how long a remote command may run on this instance,
+// whatever the caller asked for.
+var ExecTimeoutMax = 10 * time.Minute
+
+const ExecChunkSize = 4096
+
+const (
+	ExecStdout = "stdout"
+	ExecStderr = "stderr"
+)
+
+type ExecResult struct {
+	ExitCode int  `data:"exit"`
+	TimedOut bool `data:"timedout,omitempty"`
+}
+
+// AllowExec lets other endpoints run the command name, resolved to path. An
+// empty path is looked up in $PATH now, so later changes to it do not widen
+// what may be run.
+func (i *Instance) AllowExec(name string, path string) error {
+	if len(path) == 0 {
+		resolved, err := exec.LookPath(name)
+		if err != nil {
+			return err
+		}
+		path = resolved
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.execAllow[name] = path
+	return nil
+}
+
+func (i *Instance) DenyExec(name string) *Instance {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.execAllow, name)
+	return i
+}
+
+// ExecAllowlist returns the allowed command names in order with their paths.
+func (i *Instance) ExecAllowlist() ([]string, map[string]string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var names []string
+	paths := make(map[string]string)
+	for name, path := range i.execAllow {
+		names = append(names, name)
+		paths[name] = path
+	}
+	sort.Strings(names)
+	return names, paths
+}
+
+// Exec runs argv on the endpoint target, which has to allow argv[0] and be
+// reachable with PermissionExec. Output is handed to onOutput in the order it
+// arrives, before Exec returns. A zero timeout leaves it to the target.
+func (i *Instance) Exec(ctx context.Context, target string, argv []string, timeout time.Duration, onOutput func(stream string, data string)) (ExecResult, error) {
+	var result ExecResult
+
+	i.mu.Lock()
+	i.nextStream++
+	stream := strconv.FormatUint(i.nextStream, 10)
+	i.streams[stream] = onOutput
+	i.mu.Unlock()
+	defer func() {
+		i.mu.Lock()
+		delete(i.streams, stream)
+		i.mu.Unlock()
+	}()
+	msg := NewMessage(MessageExec)
+	msg.Encode(ExecPayload{To: target, Argv: argv, Timeout: timeout, Stream: stream})
+
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return result, err
+	}
+
+	if !msg.Success {
+		return result, msg.Err()
+	}
+
+	err = msg.Decode(&result)
+	return result, err
+}
+
+func (i *Instance) receiveExecOutput(output *ExecOutputPayload) {
+	i.mu.RLock()
+	handler := i.streams[output.Stream]
+	i.mu.RUnlock()
+
+	if handler != nil {
+		handler(output.FD, string(output.Data))
+	}
+}
+
+// runExec serves an exec request forwarded by the broker. Output and the
+// final reply go through the regular send queue so they stay in order.
+func (i *Instance) runExec(msg Message, req *ExecPayload) {
+	msg.Reply = true
+	delete(msg.Data, "argv")
+
+	reply := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+		defer cancel()
+		if err := i.Send(ctx, msg); err != nil {
+			log.Printf("Instance: [Warning] Failed to return exec result (%v)\n", err)
+		}
+	}
+
+	argv := req.Argv
+	i.mu.RLock()
+	path, ok := i.execAllow[argv[0]]
+	i.mu.RUnlock()
+	if !ok {
+		log.Printf("Instance: Refusing to execute %v for %v\n", argv, req.From)
+		msg.Failf(CodeRefused, "Command not allowed: %v", argv[0])
+		reply()
+		return
+	}
+
+	timeout := ExecTimeoutMax
+	if req.Timeout > 0 && req.Timeout < timeout {
+		timeout = req.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, argv[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		msg.Fail(err)
+		reply()
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		msg.Fail(err)
+		reply()
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		msg.Fail(err)
+		reply()
+		return
+	}
+	log.Printf("Instance: Executing %v for %v\n", argv, req.From)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go i.streamExecOutput(&wg, req.Stream, ExecStdout, stdout)
+	go i.streamExecOutput(&wg, req.Stream, ExecStderr, stderr)
+	wg.Wait()
+	cmd.Wait()
+
+	msg.Success = true
+	msg.Encode(ExecResult{cmd.ProcessState.ExitCode(), errors.Is(ctx.Err(), context.DeadlineExceeded)})
+	reply()
+}
+
+func (i *Instance) streamExecOutput(wg *sync.WaitGroup, stream string, fd string, r io.Reader) {
+	defer wg.Done()
+
+	buf := make([]byte, ExecChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			// chunks may end mid rune or be binary, a []byte travels in base64
+			evt := NewMessage(MessageExecOutput)
+			evt.Encode(ExecOutputPayload{stream, fd, buf[:n]})
+			ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+			i.Send(ctx, evt)
+			cancel()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Files move in chunks of FileChunkSize, each one a request through the
+// broker, so a transfer never holds more than a chunk in memory and can pick
+// up where it stopped from the partial file.
+const (
+	FileChunkSize = 64 * 1024
+	FileChunkMax  = 1024 * 1024
+	FilePartial   = ".part"
+)
+
+// DefaultFileLimit is the largest file a broker lets through unless told
+// otherwise.
+const DefaultFileLimit = 1 << 30
+
+const (
+	FilePush = "push"
+	FilePull = "pull"
+)
+
+// FileRequestTimeout bounds every single chunk of a transfer rather than all
+// of it, so a stalled peer fails the transfer however large the file is.
+var FileRequestTimeout = 30 * time.Second
+
+type FileProgress func(done int64, total int64)
+
+func isFileMessage(typ int) bool {
+	switch typ {
+	case MessageFileStat, MessageFileWrite, MessageFileRead, MessageFileCommit:
+		return true
+	}
+	return false
+}
+
+// ServeFiles lets other endpoints push to and pull from dir, given the
+// PermissionFile. Paths are always resolved inside of it.
+func (i *Instance) ServeFiles(dir string) error {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+	if info, err := os.Stat(root); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return errors.New("Not a directory: " + root)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.fileRoot = root
+	return nil
+}
+
+func (i *Instance) FileRoot() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.fileRoot
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readDigest(f)
+}
+
+func readDigest(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// resolveFile maps a requested path into root, refusing anything that ends
+// up outside of it through symlinks.
+func resolveFile(root string, path string) (string, error) {
+	if len(root) == 0 {
+		return "", &ProtocolError{CodeRefused, "Endpoint does not serve files"}
+	}
+	full := filepath.Join(root, filepath.Clean("/"+path))
+	if full == root {
+		return "", &ProtocolError{CodeInvalid, "Invalid path"}
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(full))
+	if err != nil {
+		return "", err
+	}
+	if dir != root && !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		return "", &ProtocolError{CodeInvalid, "Invalid path"}
+	}
+	if target, err := filepath.EvalSymlinks(full); err == nil {
+		if !strings.HasPrefix(target, root+string(filepath.Separator)) {
+			return "", &ProtocolError{CodeInvalid, "Invalid path"}
+		}
+	}
+	return filepath.Join(dir, filepath.Base(full)), nil
+}
+
+// openPartial opens the file a push to path is received in. A link there
+// could lead out of the served directory, so it is never followed.
+func openPartial(path string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(path+FilePartial, flag|syscall.O_NOFOLLOW, 0644)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, &ProtocolError{CodeInvalid, "Invalid path"}
+	}
+	return f, err
+}
+
+func (i *Instance) fileRequest(ctx context.Context, typ int, payload interface{}) (FileReply, error) {
+	var reply FileReply
+	msg := NewMessage(typ)
+	msg.Encode(payload)
+
+	ctx, cancel := context.WithTimeout(ctx, FileRequestTimeout)
+	defer cancel()
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return reply, err
+	}
+	if !msg.Success {
+		return reply, msg.Err()
+	}
+	return reply, msg.Decode(&reply)
+}
+
+// PushFile sends the local file to remote on endpoint to, continuing a
+// previously interrupted push of the same file.
+func (i *Instance) PushFile(ctx context.Context, to string, local string, remote string, progress FileProgress) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	digest, err := fileDigest(local)
+	if err != nil {
+		return err
+	}
+
+	reply, err := i.fileRequest(ctx, MessageFileStat, FileStatPayload{To: to, Path: remote, Mode: FilePush, Size: size})
+	if err != nil {
+		return err
+	}
+	offset := reply.Offset
+	if offset > 0 {
+		log.Printf("Instance: Resuming push of %v at %v bytes\n", local, offset)
+	}
+
+	buf := make([]byte, FileChunkSize)
+	for offset < size {
+		n, err := f.ReadAt(buf, offset)
+		if n == 0 && err != nil {
+			return err
+		}
+		if _, err := i.fileRequest(ctx, MessageFileWrite, FileWritePayload{To: to, Path: remote, Offset: offset, Data: buf[:n]}); err != nil {
+			return err
+		}
+		offset += int64(n)
+		if progress != nil {
+			progress(offset, size)
+		}
+	}
+
+	_, err = i.fileRequest(ctx, MessageFileCommit, FileCommitPayload{To: to, Path: remote, Size: size, SHA256: digest})
+	return err
+}
+
+// PullFile fetches remote from endpoint from into local, continuing from
+// local's partial file if one is left over.
+func (i *Instance) PullFile(ctx context.Context, from string, remote string, local string, progress FileProgress) error {
+	reply, err := i.fileRequest(ctx, MessageFileStat, FileStatPayload{To: from, Path: remote, Mode: FilePull})
+	if err != nil {
+		return err
+	}
+	size, digest := reply.Size, reply.SHA256
+
+	partial := local + FilePartial
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+	if offset > size {
+		offset = 0
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if offset > 0 {
+		log.Printf("Instance: Resuming pull of %v at %v bytes\n", remote, offset)
+	}
+
+	for offset < size {
+		length := size - offset
+		if length > FileChunkSize {
+			length = FileChunkSize
+		}
+		reply, err := i.fileRequest(ctx, MessageFileRead, FileReadPayload{To: from, Path: remote, Offset: offset, Length: length})
+		if err != nil {
+			return err
+		}
+		chunk := reply.Data
+		if len(chunk) == 0 {
+			return errors.New("File changed while pulling")
+		}
+		if _, err := f.WriteAt(chunk, offset); err != nil {
+			return err
+		}
+		offset += int64(len(chunk))
+		if progress != nil {
+			progress(offset, size)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if sum, err := fileDigest(partial); err != nil {
+		return err
+	} else if sum != digest {
+		os.Remove(partial)
+		return errors.New("Checksum mismatch, partial file discarded")
+	}
+	return os.Rename(partial, local)
+}
+
+// serveFile answers a file request forwarded by the broker.
+func (i *Instance) serveFile(msg Message, payload interface{}) {
+	msg.Reply = true
+	delete(msg.Data, "data")
+
+	if reply, err := i.handleFile(msg.Data["path"], payload); err != nil {
+		// callers have no business knowing where the served directory is
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		msg.Fail(err)
+	} else {
+		msg.Encode(reply)
+		msg.Success = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+	defer cancel()
+	if err := i.Send(ctx, msg); err != nil {
+		log.Printf("Instance: [Warning] Failed to answer file request (%v)\n", err)
+	}
+}
+
+func (i *Instance) handleFile(name string, payload interface{}) (FileReply, error) {
+	var reply FileReply
+	path, err := resolveFile(i.FileRoot(), name)
+	if err != nil {
+		return reply, err
+	}
+	partial := path + FilePartial
+
+	switch req := payload.(type) {
+	case *FileStatPayload:
+		if req.Mode == FilePull {
+			info, err := os.Stat(path)
+			if err != nil {
+				return reply, err
+			}
+			if !info.Mode().IsRegular() {
+				return reply, errors.New("Not a regular file")
+			}
+			digest, err := fileDigest(path)
+			if err != nil {
+				return reply, err
+			}
+			log.Printf("Instance: %v pulls %v\n", req.From, path)
+			reply.Size, reply.SHA256 = info.Size(), digest
+			return reply, nil
+		}
+
+		f, err := openPartial(path, os.O_CREATE|os.O_WRONLY)
+		if err != nil {
+			return reply, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return reply, err
+		}
+		offset := info.Size()
+		if offset > req.Size {
+			offset = 0
+		}
+		if err := f.Truncate(offset); err != nil {
+			return reply, err
+		}
+		log.Printf("Instance: %v pushes %v\n", req.From, path)
+		reply.Offset = offset
+		return reply, nil
+	case *FileWritePayload:
+		f, err := openPartial(path, os.O_WRONLY)
+		if err != nil {
+			return reply, err
+		}
+		defer f.Close()
+		_, err = f.WriteAt(req.Data, req.Offset)
+		return reply, err
+	case *FileReadPayload:
+		if req.Length < 0 || req.Length > FileChunkMax {
+			return reply, &ProtocolError{CodeInvalid, "Invalid length"}
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return reply, err
+		}
+		defer f.Close()
+		buf := make([]byte, req.Length)
+		n, err := f.ReadAt(buf, req.Offset)
+		if err != nil && err != io.EOF {
+			return reply, err
+		}
+		reply.Data = buf[:n]
+		return reply, nil
+	case *FileCommitPayload:
+		f, err := openPartial(path, os.O_RDONLY)
+		if err != nil {
+			return reply, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return reply, err
+		}
+		if info.Size() != req.Size {
+			return reply, errors.New("Incomplete transfer")
+		}
+		digest, err := readDigest(f)
+		if err != nil {
+			return reply, err
+		}
+		if digest != req.SHA256 {
+			os.Remove(partial)
+			return reply, errors.New("Checksum mismatch, partial file discarded")
+		}
+		// a directory on the way may have been swapped for a link meanwhile
+		if again, err := resolveFile(i.FileRoot(), name); err != nil || again != path {
+			return reply, &ProtocolError{CodeInvalid, "Invalid path"}
+		}
+		log.Printf("Instance: Received %v from %v\n", path, req.From)
+		return reply, os.Rename(partial, path)
+	}
+	return reply, errors.New("Unknown file request")
+}
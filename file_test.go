@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandleFilePartialLink(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	i := NewInstance("", false)
+	if err := i.ServeFiles(root); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(outside, "escaped")
+	if err := os.Symlink(target, filepath.Join(root, "x"+FilePartial)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := i.handleFile("x", &FileStatPayload{Path: "x", Mode: FilePush, Size: 4}); err == nil {
+		t.Error("push through a linked partial file accepted")
+	}
+	if _, err := i.handleFile("x", &FileWritePayload{Path: "x", Data: []byte("evil")}); err == nil {
+		t.Error("write through a linked partial file accepted")
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Error("file created outside the served directory")
+	}
+
+	// nor is a file outside moved into place through one
+	if err := ioutil.WriteFile(target, []byte("evil"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := fileDigest(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.handleFile("x", &FileCommitPayload{Path: "x", Size: 4, SHA256: digest}); err == nil {
+		t.Error("commit through a linked partial file accepted")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "x")); !os.IsNotExist(err) {
+		t.Error("file outside the served directory moved into it")
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/c-bata/go-prompt v0.2.6
 	github.com/logrusorgru/aurora/v3 v3.0.0
 	github.com/pkg/term v1.2.0-beta.2
-	golang.org/x/net v0.0.0-20210324205630-d1beb07c2056
-	golang.org/x/sys v0.0.0-20210324051608-47abb6519492
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 )
@@ -1,14 +1,36 @@
 package main
 
 import (
-	"errors"
+	"sort"
+	"sync"
 )
 
 type Group struct {
 	Entity
 
+	mu        sync.RWMutex
 	groups    map[*Group]struct{}
 	endpoints map[*Endpoint]struct{}
+	perms     map[string]struct{}
+}
+
+// Permissions a group grants its members on each other's endpoints.
+const (
+	PermissionExec   = "exec"
+	PermissionFile   = "file"
+	PermissionTunnel = "tunnel"
+	PermissionShell  = "shell"
+)
+
+var Permissions = []string{PermissionExec, PermissionFile, PermissionTunnel, PermissionShell}
+
+func validPermission(perm string) error {
+	for _, known := range Permissions {
+		if perm == known {
+			return nil
+		}
+	}
+	return &ProtocolError{CodeInvalid, "Unknown permission " + perm}
 }
 
 func NewGroup(name string) *Group {
@@ -17,6 +39,7 @@ func NewGroup(name string) *Group {
 
 	g.groups = make(map[*Group]struct{})
 	g.endpoints = make(map[*Endpoint]struct{})
+	g.perms = make(map[string]struct{})
 
 	return &g
 }
@@ -33,65 +56,97 @@ func (g *Group) SetOwner(owner *User) *Group {
 }
 
 func (g *Group) AddGroup(group *Group) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	g.groups[group] = struct{}{}
 }
 
 func (g *Group) AddEndpoint(endpoint *Endpoint) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	g.endpoints[endpoint] = struct{}{}
 }
 
 func (g *Group) RemoveGroup(group *Group) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	delete(g.groups, group)
 }
 
 func (g *Group) RemoveEndpoint(endpoint *Endpoint) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	delete(g.endpoints, endpoint)
 }
 
+func (g *Group) Allow(perm string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.perms[perm] = struct{}{}
+}
+
+func (g *Group) Revoke(perm string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.perms, perm)
+}
+
+func (g *Group) Allowed(perm string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	_, ok := g.perms[perm]
+	return ok
+}
+
+func (g *Group) Permissions() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var ret []string
+	for perm := range g.perms {
+		ret = append(ret, perm)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 func (g *Group) GetGroup(name string) (*Group, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	for value, _ := range g.groups {
-		if _, ok := g.groups[value]; ok {
-			if value.Name() == name {
-				return value, nil
-			}
+		if value.Name() == name {
+			return value, nil
 		}
 	}
-	return nil, errors.New("Group not found")
+	return nil, &ProtocolError{CodeNotFound, "Group not found"}
 }
 
 func (g *Group) GetEndpoint(name string) (*Endpoint, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	for value, _ := range g.endpoints {
-		if _, ok := g.endpoints[value]; ok {
-			if value.Name() == name {
-				return value, nil
-			}
+		if value.Name() == name {
+			return value, nil
 		}
 	}
-	return nil, errors.New("Endpoint not found")
+	return nil, &ProtocolError{CodeNotFound, "Endpoint not found"}
 }
 
 func (g *Group) Groups() []*Group {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	var ret []*Group
 	for value, _ := range g.groups {
-		if _, ok := g.groups[value]; ok {
-			ret = append(ret, value)
-		} else {
-			// clean up bad groups while we're at it
-			delete(g.groups, value)
-		}
+		ret = append(ret, value)
 	}
 	return ret
 }
 
 func (g *Group) Endpoints() []*Endpoint {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	var ret []*Endpoint
 	for value, _ := range g.endpoints {
-		if _, ok := g.endpoints[value]; ok {
-			ret = append(ret, value)
-		} else {
-			// clean up bad endpoints while we're at it
-			delete(g.endpoints, value)
-		}
+		ret = append(ret, value)
 	}
 	return ret
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+var GroupExecConcurrency = 8
+
+// A GroupEndpoint is an endpoint a group send or exec reaches, see
+// State.ExpandGroup.
+type GroupEndpoint struct {
+	Name   string
+	Owner  string
+	Online bool
+}
+
+// A GroupExecResult summarises one endpoint's run. Error is set when the
+// command never ran there, i.e. because the endpoint is offline.
+type GroupExecResult struct {
+	Endpoint string
+	Online   bool
+	ExitCode int
+	TimedOut bool
+	Error    string `json:",omitempty"`
+	Duration time.Duration
+	Output   int    // bytes of stdout and stderr
+	Digest   string // sha256 of the output, to spot hosts that differ
+}
+
+func (i *Instance) GroupEndpoints(ctx context.Context, group string) ([]GroupEndpoint, error) {
+	msg := NewMessage(MessageListGroupEndpoints)
+	msg.Encode(ListGroupEndpointsPayload{group})
+
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Success {
+		var endpoints []GroupEndpoint
+		if err := json.Unmarshal([]byte(msg.Data["endpoints"]), &endpoints); err != nil {
+			return nil, err
+		}
+		return endpoints, nil
+	}
+
+	return nil, msg.Err()
+}
+
+// GroupExec runs argv on every online endpoint in group, at most limit at a
+// time, and returns a result per endpoint ordered by name. Offline endpoints
+// are included with an error instead of being skipped. Each endpoint gets
+// DeliveryTimeout on top of the timeout, or of ExecTimeoutMax without one, to
+// report back, so a stalled one never holds up the rest.
+func (i *Instance) GroupExec(ctx context.Context, group string, argv []string, timeout time.Duration, limit int) ([]GroupExecResult, error) {
+	listCtx, cancel := context.WithTimeout(ctx, DeliveryTimeout)
+	endpoints, err := i.GroupEndpoints(listCtx, group)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if limit < 1 {
+		limit = GroupExecConcurrency
+	}
+
+	results := make([]GroupExecResult, len(endpoints))
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for n, endpoint := range endpoints {
+		results[n] = GroupExecResult{Endpoint: endpoint.Name, Online: endpoint.Online}
+		if !endpoint.Online {
+			results[n].Error = "Endpoint is offline"
+			continue
+		}
+		wg.Add(1)
+		go func(result *GroupExecResult) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			bound := ExecTimeoutMax
+			if timeout > 0 && timeout < bound {
+				bound = timeout
+			}
+			execCtx, cancel := context.WithTimeout(ctx, bound+DeliveryTimeout)
+			defer cancel()
+
+			var mu sync.Mutex
+			digest := sha256.New()
+			start := time.Now()
+			ret, err := i.Exec(execCtx, result.Endpoint, argv, timeout, func(stream string, data string) {
+				mu.Lock()
+				defer mu.Unlock()
+				digest.Write([]byte(data))
+				result.Output += len(data)
+			})
+			result.Duration = time.Since(start)
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+			result.ExitCode = ret.ExitCode
+			result.TimedOut = ret.TimedOut
+			mu.Lock()
+			result.Digest = hex.EncodeToString(digest.Sum(nil))
+			mu.Unlock()
+		}(&results[n])
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Endpoint < results[j].Endpoint
+	})
+	return results, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	DefaultHeartbeatInterval = 15 * time.Second
+	DefaultHeartbeatTimeout  = 10 * time.Second
+)
+
+type Heartbeat struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func DefaultHeartbeat() Heartbeat {
+	return Heartbeat{DefaultHeartbeatInterval, DefaultHeartbeatTimeout}
+}
+
+func (h Heartbeat) Valid() error {
+	if h.Interval <= 0 || h.Timeout <= 0 {
+		return errors.New("Heartbeat interval and timeout have to be positive")
+	}
+	return nil
+}
+
+// Run pings the peer every interval until quit is closed. Every answered ping
+// reports its round trip to measured, the first unanswered one ends the loop
+// with an error so the caller can drop the connection.
+func (h Heartbeat) Run(quit <-chan struct{}, execute func(context.Context, Message) (Message, error), measured func(time.Duration)) error {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return nil
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+		start := time.Now()
+		_, err := execute(ctx, NewMessage(MessagePing))
+		cancel()
+		if err != nil {
+			select {
+			case <-quit:
+				// connection went away on its own
+				return nil
+			default:
+				return err
+			}
+		}
+		measured(time.Since(start))
+	}
+}
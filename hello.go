@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// ProtocolVersion is bumped whenever the wire format changes incompatibly.
+// Peers refuse each other unless both speak a version the other supports.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// SoftwareVersion is informational, set it with
+// -ldflags "-X main.SoftwareVersion=..." when building releases.
+var SoftwareVersion = "dev"
+
+var HelloTimeout = 10 * time.Second
+
+// Features a peer advertises in its hello. Messages belonging to a feature are
+// only sent to peers that announced it.
+const (
+	FeatureTopics  = "topics"
+	FeatureExec    = "exec"
+	FeatureFiles   = "files"
+	FeatureStreams = "streams"
+	FeatureMailbox = "mailbox"
+)
+
+var Features = []string{FeatureTopics, FeatureExec, FeatureFiles, FeatureStreams, FeatureMailbox}
+
+var messageFeatures = map[int]string{
+	MessageSubscribe:          FeatureTopics,
+	MessageUnsubscribe:        FeatureTopics,
+	MessagePublish:            FeatureTopics,
+	MessageExec:               FeatureExec,
+	MessageExecOutput:         FeatureExec,
+	MessageListGroupEndpoints: FeatureExec,
+	MessageFileStat:           FeatureFiles,
+	MessageFileWrite:          FeatureFiles,
+	MessageFileRead:           FeatureFiles,
+	MessageFileCommit:         FeatureFiles,
+	MessageStreamOpen:         FeatureStreams,
+	MessageStreamData:         FeatureStreams,
+	MessageStreamWindow:       FeatureStreams,
+	MessageStreamClose:        FeatureStreams,
+	MessageStreamControl:      FeatureStreams,
+}
+
+// ErrHandshake wraps every reason a hello exchange failed for, reconnecting
+// will not help with any of them.
+var ErrHandshake = errors.New("Handshake refused")
+
+// An UnsupportedError is a message withheld from a peer that did not
+// advertise the feature it belongs to.
+type UnsupportedError struct {
+	Feature string
+}
+
+func (e *UnsupportedError) Error() string {
+	return "Peer does not support " + e.Feature
+}
+
+func (e *UnsupportedError) Unwrap() error {
+	return ErrUnsupported
+}
+
+// A Hello is what each side of a connection announces about itself before
+// anything else is exchanged.
+type Hello struct {
+	Protocol int         `data:"protocol,required"`
+	Software string      `data:"software"`
+	Features FeatureList `data:"features"`
+}
+
+// A FeatureList travels comma separated.
+type FeatureList []string
+
+func (l FeatureList) MarshalText() ([]byte, error) {
+	return []byte(strings.Join(l, ",")), nil
+}
+
+func (l *FeatureList) UnmarshalText(text []byte) error {
+	*l = nil
+	if len(text) > 0 {
+		*l = strings.Split(string(text), ",")
+		sort.Strings(*l)
+	}
+	return nil
+}
+
+func LocalHello() Hello {
+	return Hello{ProtocolVersion, SoftwareVersion, Features}
+}
+
+func (h Hello) Supports(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows tells whether msg may be sent to the peer. Replies always may, they
+// answer something the peer sent.
+func (h Hello) Allows(msg Message) error {
+	if msg.Reply {
+		return nil
+	}
+	if feature, ok := messageFeatures[msg.Type]; ok && !h.Supports(feature) {
+		return &UnsupportedError{feature}
+	}
+	return nil
+}
+
+func (h Hello) Compatible() error {
+	if h.Protocol < MinProtocolVersion || h.Protocol > ProtocolVersion {
+		return fmt.Errorf("%w: protocol %v is not supported, only %v to %v", ErrHandshake, h.Protocol, MinProtocolVersion, ProtocolVersion)
+	}
+	return nil
+}
+
+func (h Hello) String() string {
+	return fmt.Sprintf("protocol %v, software %v, features %v", h.Protocol, h.Software, strings.Join(h.Features, ","))
+}
+
+func decodeHello(msg Message) (Hello, error) {
+	var h Hello
+	if err := msg.Decode(&h); err != nil {
+		return h, fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+	return h, nil
+}
+
+// greet sends our hello as the first frame of a connection and reads the
+// broker's in return.
+func greet(ws *websocket.Conn) (Hello, error) {
+	ws.SetDeadline(time.Now().Add(HelloTimeout))
+	defer ws.SetDeadline(time.Time{})
+
+	msg := NewMessage(MessageHello)
+	msg.Encode(LocalHello())
+	if err := websocket.JSON.Send(ws, msg); err != nil {
+		return Hello{}, err
+	}
+	var reply Message
+	if err := websocket.JSON.Receive(ws, &reply); err != nil {
+		return Hello{}, err
+	}
+	if reply.Type != MessageHello || !reply.Reply {
+		return Hello{}, fmt.Errorf("%w: broker did not answer the hello", ErrHandshake)
+	}
+	if !reply.Success {
+		reason := strings.TrimPrefix(reply.Data["message"], ErrHandshake.Error()+": ")
+		return Hello{}, fmt.Errorf("%w: %v", ErrHandshake, reason)
+	}
+	peer, err := decodeHello(reply)
+	if err != nil {
+		return Hello{}, err
+	}
+	return peer, peer.Compatible()
+}
+
+// welcome expects a hello as the first frame of a connection, and answers it
+// with ours unless the peer is incompatible.
+func welcome(ws *websocket.Conn) (Hello, error) {
+	ws.SetDeadline(time.Now().Add(HelloTimeout))
+	defer ws.SetDeadline(time.Time{})
+
+	var msg Message
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		return Hello{}, err
+	}
+	var peer Hello
+	err := fmt.Errorf("%w: expected hello, got message type %v", ErrHandshake, msg.Type)
+	if msg.Type == MessageHello {
+		if peer, err = decodeHello(msg); err == nil {
+			err = peer.Compatible()
+		}
+	}
+
+	// peers predating the handshake see their first request fail
+	msg.Reply = true
+	msg.Data = make(map[string]string)
+	if err != nil {
+		msg.Fail(err)
+	} else {
+		msg.Encode(LocalHello())
+		msg.Success = true
+	}
+	websocket.JSON.Send(ws, msg)
+	return peer, err
+}
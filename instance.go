@@ -1,137 +1,313 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
 
+type ConnState int
+
+const (
+	ConnConnecting ConnState = iota
+	ConnConnected
+	ConnResumed
+	ConnRejected
+	ConnDisconnected
+	ConnClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case ConnConnecting:
+		return "connecting"
+	case ConnConnected:
+		return "connected"
+	case ConnResumed:
+		return "resumed"
+	case ConnRejected:
+		return "rejected"
+	case ConnDisconnected:
+		return "disconnected"
+	case ConnClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+type ConnEvent struct {
+	State ConnState
+	Err   error
+	Retry time.Duration
+}
+
+var (
+	ReconnectBackoffMin = 500 * time.Millisecond
+	ReconnectBackoffMax = 30 * time.Second
+	ResumeTimeout       = 10 * time.Second
+)
+
+// A login is resumed with a token issued right after it, the password is
+// never kept. SessionTokenTTL is how long that token lasts.
+var SessionTokenTTL = 7 * 24 * time.Hour
+
 type Instance struct {
 	brokerAddr string
 	secure     bool
-	socket     *websocket.Conn
+	rootCAs    *x509.CertPool
+	clientCert *tls.Certificate
 	send       chan Message
-	recv       chan Message
+	pending    *Pending
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	mu             sync.RWMutex
+	socket         *websocket.Conn
+	peer           Hello
+	connState      ConnState
+	onConn         func(ConnEvent)
+	onMessage      func(from string, data string)
+	onTopic        func(topic string, from string, data string)
+	execAllow      map[string]string
+	fileRoot       string
+	shell          string
+	exposed        map[string]struct{}
+	forwards       map[string]*Forward
+	conns          map[string]*Stream
+	streamHandlers map[string]func(req *StreamRequest)
+	streams        map[string]func(stream string, data string)
+	nextStream     uint64
+	heartbeat      Heartbeat
+	latency        time.Duration
+
+	// credentials and identity replayed when the connection is resumed
+	token    string
+	issued   bool // token was issued for resuming a login
+	hostname string
+	topics   map[topicSubscription]struct{}
 
 	self *Endpoint
 
 	state *State
 }
 
+// Peer returns what the broker announced in its hello, it is the zero Hello
+// until connected.
+func (i *Instance) Peer() Hello {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.peer
+}
+
 func (i *Instance) Self() *Endpoint {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	return i.self
 }
 
 func (i *Instance) SetSelf(e *Endpoint) *Instance {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	i.self = e
 	return i
 }
 
-func (i *Instance) Auth(token string) error {
+func (i *Instance) Auth(ctx context.Context, token string) error {
+	return i.auth(ctx, token, i.send)
+}
+
+func (i *Instance) auth(ctx context.Context, token string, queue chan Message) error {
 	var msg Message
 	msg.Type = MessageAuth
-	msg.Data = make(map[string]string)
-	msg.Data["token"] = token
+	msg.Encode(AuthPayload{token})
 
-	msg = i.Execute(msg)
+	msg, err := i.execute(ctx, msg, queue)
+	if err != nil {
+		return err
+	}
 
 	if msg.Success {
+		i.mu.Lock()
+		i.token, i.issued = token, false
+		i.mu.Unlock()
 		return nil
 	}
 
-	return errors.New(msg.Data["message"])
+	return msg.Err()
 }
 
-func (i *Instance) NewAuthToken() (string, error) {
-	var msg Message
-	msg.Type = MessageNewAuthToken
+func (i *Instance) NewAuthToken(ctx context.Context, label string, ttl time.Duration, endpoint string) (string, error) {
+	return i.newAuthToken(ctx, label, ttl, endpoint, i.send)
+}
 
-	msg = i.Execute(msg)
+func (i *Instance) newAuthToken(ctx context.Context, label string, ttl time.Duration, endpoint string, queue chan Message) (string, error) {
+	msg := NewMessage(MessageNewAuthToken)
+	msg.Encode(NewAuthTokenPayload{label, ttl, endpoint})
+
+	msg, err := i.execute(ctx, msg, queue)
+	if err != nil {
+		return "", err
+	}
 
 	if msg.Success {
 		return msg.Data["token"], nil
 	}
 
-	return "", errors.New(msg.Data["message"])
+	return "", msg.Err()
 }
 
-func (i *Instance) DeleteAuthToken(token string) error {
+func (i *Instance) DeleteAuthToken(ctx context.Context, token string) error {
 	var msg Message
 	msg.Type = MessageDeleteAuthToken
-	msg.Data = make(map[string]string)
-	msg.Data["token"] = token
+	msg.Encode(DeleteAuthTokenPayload{token})
 
-	msg = i.Execute(msg)
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return err
+	}
 
 	if msg.Success {
 		return nil
 	}
 
-	return errors.New(msg.Data["message"])
+	return msg.Err()
 }
 
-func (i *Instance) Login(username string, password string) error {
-	var msg Message
-	msg.Type = MessageLogin
-	msg.Data = make(map[string]string)
-	msg.Data["username"] = username
-	msg.Data["password"] = password
+func (i *Instance) ListAuthTokens(ctx context.Context) ([]Token, error) {
+	msg := NewMessage(MessageListAuthTokens)
 
-	msg = i.Execute(msg)
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
 
 	if msg.Success {
-		return nil
+		var tokens []Token
+		if err := json.Unmarshal([]byte(msg.Data["tokens"]), &tokens); err != nil {
+			return nil, err
+		}
+		return tokens, nil
 	}
 
-	return errors.New(msg.Data["message"])
+	return nil, msg.Err()
 }
 
-func (i *Instance) Logoff() error {
+func (i *Instance) Login(ctx context.Context, username string, password string) error {
+	var msg Message
+	msg.Type = MessageLogin
+	msg.Encode(LoginPayload{username, password})
+
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if !msg.Success {
+		return msg.Err()
+	}
+
+	i.mu.RLock()
+	token := i.token
+	i.mu.RUnlock()
+	if len(token) == 0 {
+		token, err = i.NewAuthToken(ctx, "session", SessionTokenTTL, "")
+		if err != nil {
+			log.Printf("Instance: [Warning] Session cannot be resumed, no token issued (%v)\n", err)
+			return nil
+		}
+		i.mu.Lock()
+		i.token, i.issued = token, true
+		i.mu.Unlock()
+	}
+	return nil
+}
+
+func (i *Instance) Logoff(ctx context.Context) error {
 	var msg Message
 	msg.Type = MessageLogoff
 
-	msg = i.Execute(msg)
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return err
+	}
 
 	if msg.Success {
 		log.Println("Instance: Logged out")
 		return nil
 	}
 
-	return errors.New(msg.Data["message"])
+	return msg.Err()
 }
 
-func (i *Instance) Deauth() error {
+func (i *Instance) Deauth(ctx context.Context) error {
+	i.mu.RLock()
+	token, issued := i.token, i.issued
+	i.mu.RUnlock()
+	if issued {
+		if err := i.DeleteAuthToken(ctx, token); err != nil {
+			log.Printf("Instance: [Warning] Failed to revoke session token (%v)\n", err)
+		}
+	}
+
 	var msg Message
 	msg.Type = MessageDeauth
 
-	msg = i.Execute(msg)
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return err
+	}
 
 	if msg.Success {
+		i.mu.Lock()
+		i.token, i.issued, i.hostname, i.self = "", false, "", nil
+		i.topics = make(map[topicSubscription]struct{})
+		i.mu.Unlock()
+		i.dropStreams()
 		log.Println("Instance: Deauthenticated")
 		return nil
 	}
 
-	return errors.New(msg.Data["message"])
+	return msg.Err()
+}
+
+func (i *Instance) Identify(ctx context.Context, hostname string) error {
+	return i.identify(ctx, hostname, i.send)
 }
 
-func (i *Instance) Identify(hostname string) error {
+func (i *Instance) identify(ctx context.Context, hostname string, queue chan Message) error {
 	var msg Message
 	msg.Type = MessageIdentify
-	msg.Data = make(map[string]string)
-	msg.Data["hostname"] = hostname
+	msg.Encode(IdentifyPayload{hostname})
 
-	msg = i.Execute(msg)
+	msg, err := i.execute(ctx, msg, queue)
+	if err != nil {
+		return err
+	}
 
 	if msg.Success {
+		i.mu.Lock()
+		i.hostname = hostname
+		// the broker drops subscriptions of whatever this session was before
+		i.topics = make(map[topicSubscription]struct{})
+		i.mu.Unlock()
+		i.dropStreams()
 		if e, err := i.State().GetEndpoint(msg.Data["hostname"]); err == nil {
 			i.SetSelf(e)
 		}
 		return nil
 	}
 
-	return errors.New(msg.Data["message"])
+	return msg.Err()
 }
 
 func NewInstance(addr string, secure bool) *Instance {
@@ -140,18 +316,335 @@ func NewInstance(addr string, secure bool) *Instance {
 	i.secure = secure
 
 	i.send = make(chan Message)
-	i.recv = make(chan Message)
+	i.pending = NewPending()
+	i.done = make(chan struct{})
+	i.heartbeat = DefaultHeartbeat()
+	i.topics = make(map[topicSubscription]struct{})
+	i.execAllow = make(map[string]string)
+	i.exposed = make(map[string]struct{})
+	i.forwards = make(map[string]*Forward)
+	i.conns = make(map[string]*Stream)
+	i.streamHandlers = make(map[string]func(req *StreamRequest))
+	i.streamHandlers[StreamTunnel] = i.acceptTunnel
+	i.streamHandlers[StreamShell] = i.acceptShell
+	i.streams = make(map[string]func(stream string, data string))
 
 	i.state = NewState()
 
 	return &i
 }
 
+// SetRootCAs pins the broker certificate to the given pool instead of the
+// system roots, i.e. for brokers signed by a private CA.
+func (i *Instance) SetRootCAs(pool *x509.CertPool) *Instance {
+	i.rootCAs = pool
+	return i
+}
+
+// SetClientCertificate presents cert to brokers requiring client
+// certificates, which authenticates the session without a login.
+func (i *Instance) SetClientCertificate(cert tls.Certificate) *Instance {
+	i.clientCert = &cert
+	return i
+}
+
 func (i *Instance) State() *State {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	return i.state
 }
 
+func (i *Instance) ConnState() ConnState {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.connState
+}
+
+func (i *Instance) Heartbeat() Heartbeat {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.heartbeat
+}
+
+// SetHeartbeat applies from the next (re)connect on.
+func (i *Instance) SetHeartbeat(heartbeat Heartbeat) error {
+	if err := heartbeat.Valid(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.heartbeat = heartbeat
+	return nil
+}
+
+// Latency is the last measured heartbeat round trip to the broker.
+func (i *Instance) Latency() time.Duration {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.latency
+}
+
+func (i *Instance) setLatency(latency time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.latency = latency
+}
+
+func (i *Instance) OnConnState(handler func(ConnEvent)) *Instance {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onConn = handler
+	return i
+}
+
+// OnMessage registers the handler for direct messages from other endpoints.
+// Each message is handled on its own goroutine, so the handler may call
+// SendTo itself. The sender's SendTo returns once the handler did, which
+// keeps the messages of every single sender in order.
+func (i *Instance) OnMessage(handler func(from string, data string)) *Instance {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onMessage = handler
+	return i
+}
+
+func (i *Instance) receiveDirect(msg Message, req *DirectPayload) {
+	i.mu.RLock()
+	handler := i.onMessage
+	i.mu.RUnlock()
+
+	msg.Reply = true
+	if handler != nil {
+		handler(req.From, req.Data)
+		msg.Success = true
+	} else {
+		msg.Failf(CodeRefused, "Endpoint does not accept messages")
+	}
+	delete(msg.Data, "data")
+
+	ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+	defer cancel()
+	if err := i.Send(ctx, msg); err != nil {
+		log.Printf("Instance: [Warning] Failed to acknowledge message from %v (%v)\n", req.From, err)
+	}
+}
+
+// SendTo delivers data to the endpoint named to, routed by the broker. It
+// fails unless the target is reachable from this endpoint, and returns
+// ErrQueued if the target is offline and gets it once it identifies.
+func (i *Instance) SendTo(ctx context.Context, to string, data string) error {
+	msg := NewMessage(MessageDirect)
+	msg.Encode(DirectPayload{To: to, Data: data})
+
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	if msg.Success {
+		if msg.Data["status"] == DeliveryQueued {
+			return ErrQueued
+		}
+		return nil
+	}
+
+	return msg.Err()
+}
+
+// SendToGroup delivers data to every endpoint in group, including nested
+// groups and member users. The result maps each recipient to nil or the
+// reason it did not get the message.
+func (i *Instance) SendToGroup(ctx context.Context, group string, data string) (map[string]error, error) {
+	msg := NewMessage(MessageGroupSend)
+	msg.Encode(GroupSendPayload{group, data})
+
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !msg.Success {
+		return nil, msg.Err()
+	}
+
+	var status map[string]string
+	if err := json.Unmarshal([]byte(msg.Data["status"]), &status); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]error)
+	for endpoint, result := range status {
+		switch result {
+		case DeliveryDelivered:
+			ret[endpoint] = nil
+		case DeliveryQueued:
+			ret[endpoint] = ErrQueued
+		default:
+			ret[endpoint] = errors.New(result)
+		}
+	}
+	return ret, nil
+}
+
+type topicSubscription struct {
+	topic string
+	group string
+}
+
+// OnTopic registers the handler for publications on subscribed topics. Each
+// publication is handled on its own goroutine, so the handler may publish or
+// execute requests itself, but publications are not handled in order.
+func (i *Instance) OnTopic(handler func(topic string, from string, data string)) *Instance {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onTopic = handler
+	return i
+}
+
+// Subscribe to topic, which may contain wildcards, see TopicWildcard and
+// TopicRest. With a group, only publications by its endpoints are received.
+// Subscriptions are restored when the session is resumed.
+func (i *Instance) Subscribe(ctx context.Context, topic string, group string) error {
+	return i.subscribe(ctx, topic, group, i.send)
+}
+
+func (i *Instance) subscribe(ctx context.Context, topic string, group string, queue chan Message) error {
+	msg := NewMessage(MessageSubscribe)
+	msg.Encode(SubscribePayload{topic, group})
+
+	msg, err := i.execute(ctx, msg, queue)
+	if err != nil {
+		return err
+	}
+
+	if msg.Success {
+		i.mu.Lock()
+		i.topics[topicSubscription{topic, group}] = struct{}{}
+		i.mu.Unlock()
+		return nil
+	}
+
+	return msg.Err()
+}
+
+func (i *Instance) Unsubscribe(ctx context.Context, topic string, group string) error {
+	msg := NewMessage(MessageUnsubscribe)
+	msg.Encode(SubscribePayload{topic, group})
+
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	delete(i.topics, topicSubscription{topic, group})
+	i.mu.Unlock()
+
+	if msg.Success {
+		return nil
+	}
+
+	return msg.Err()
+}
+
+// Publish data on topic and return how many subscribers it was handed to.
+func (i *Instance) Publish(ctx context.Context, topic string, data string) (int, error) {
+	msg := NewMessage(MessagePublish)
+	msg.Encode(PublishPayload{Topic: topic, Data: data})
+
+	msg, err := i.Execute(ctx, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	if msg.Success {
+		return strconv.Atoi(msg.Data["subscribers"])
+	}
+
+	return 0, msg.Err()
+}
+
+func (i *Instance) emitConnState(event ConnEvent) {
+	i.mu.Lock()
+	i.connState = event.State
+	handler := i.onConn
+	i.mu.Unlock()
+
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// Close stops reconnecting and tears down the current connection.
+func (i *Instance) Close() {
+	i.closeOnce.Do(func() {
+		close(i.done)
+		i.mu.RLock()
+		if i.socket != nil {
+			i.socket.Close()
+		}
+		for _, forward := range i.forwards {
+			forward.listener.Close()
+		}
+		i.mu.RUnlock()
+		i.pending.Close()
+	})
+}
+
+func (i *Instance) closed() bool {
+	select {
+	case <-i.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ConnectAndRecv keeps the instance connected until Close is called,
+// reconnecting with jittered exponential backoff whenever the link drops.
 func (i *Instance) ConnectAndRecv() (err error) {
+	attempt := 0
+	for {
+		i.emitConnState(ConnEvent{State: ConnConnecting})
+		var connected bool
+		connected, err = i.session(attempt > 0)
+		if i.closed() {
+			i.emitConnState(ConnEvent{State: ConnClosed})
+			return nil
+		}
+		if connected {
+			attempt = 0
+		} else if errors.Is(err, ErrHandshake) {
+			log.Printf("Instance: Giving up on %v (%v)\n", i.brokerAddr, err)
+			i.emitConnState(ConnEvent{State: ConnClosed, Err: err})
+			return err
+		}
+
+		retry := reconnectBackoff(attempt)
+		attempt++
+		i.emitConnState(ConnEvent{State: ConnDisconnected, Err: err, Retry: retry})
+
+		select {
+		case <-time.After(retry):
+		case <-i.done:
+			i.emitConnState(ConnEvent{State: ConnClosed})
+			return nil
+		}
+	}
+}
+
+func reconnectBackoff(attempt int) time.Duration {
+	ceiling := ReconnectBackoffMin
+	for n := 0; n < attempt && ceiling < ReconnectBackoffMax; n++ {
+		ceiling *= 2
+	}
+	if ceiling > ReconnectBackoffMax {
+		ceiling = ReconnectBackoffMax
+	}
+	// full jitter keeps a fleet of endpoints from reconnecting in lockstep
+	return ReconnectBackoffMin/2 + time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+func (i *Instance) session(resume bool) (bool, error) {
 	log.Printf("Instance: Connecting to %v\n", i.brokerAddr)
 
 	proto := "wss"
@@ -160,128 +653,334 @@ func (i *Instance) ConnectAndRecv() (err error) {
 		log.Println("Instance: [Warning] Instance.secure = false - connecting to plaintext websocket")
 	}
 
-	i.socket, err = websocket.Dial(fmt.Sprintf("%s://%s/broker", proto, i.brokerAddr), "", i.brokerAddr)
+	config, err := websocket.NewConfig(fmt.Sprintf("%s://%s/broker", proto, i.brokerAddr), fmt.Sprintf("https://%s/", i.brokerAddr))
+	if err != nil {
+		return false, err
+	}
+	if i.secure {
+		host, _, _ := net.SplitHostPort(i.brokerAddr)
+		config.TlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    i.rootCAs,
+			ServerName: host,
+		}
+		if i.clientCert != nil {
+			config.TlsConfig.Certificates = []tls.Certificate{*i.clientCert}
+		}
+	}
 
+	socket, err := websocket.DialConfig(config)
 	if err != nil {
-		log.Fatal(err)
-		return err
+		return false, err
 	}
+	defer socket.Close()
 
+	peer, err := greet(socket)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Instance: Broker speaks %v\n", peer)
+
+	i.mu.Lock()
+	i.socket = socket
+	i.peer = peer
+	if resume {
+		// the broker pushes its state again once we are authenticated
+		i.state = NewState()
+		i.self = nil
+	}
+	i.mu.Unlock()
+	if i.closed() {
+		return true, nil
+	}
+
+	lost := make(chan error, 1)
+	quit := make(chan struct{})
 	go func() {
 		for {
-			if err := websocket.JSON.Send(i.socket, <-i.send); err != nil {
-				log.Fatal(err)
+			var msg Message
+			if err := websocket.JSON.Receive(socket, &msg); err != nil {
+				close(quit)
+				i.pending.Reset()
+				i.dropStreams()
+				lost <- err
+				return
+			}
+			if msg.Data == nil {
+				msg.Data = make(map[string]string)
+			}
+			if msg.Reply {
+				if !i.pending.Resolve(msg) {
+					log.Printf("Instance: Dropping unsolicited reply %v\n", msg.ID)
+				}
+				continue
+			}
+			if msg.Type == MessagePing {
+				msg.Reply = true
+				msg.Success = true
+				websocket.JSON.Send(socket, msg)
+				continue
+			}
+
+			payload, err := msg.Payload()
+			if err != nil {
+				log.Printf("Instance: Dropping malformed message type %v (%v)\n", msg.Type, err)
+				// only requests routed to this endpoint expect an answer
+				if msg.Type == MessageDirect || msg.Type == MessageExec || isFileMessage(msg.Type) || msg.Type == MessageStreamOpen {
+					msg.Reply = true
+					msg.Fail(err)
+					websocket.JSON.Send(socket, msg)
+				}
+				continue
 			}
+			switch {
+			case msg.Type == MessageDirect:
+				go i.receiveDirect(msg, payload.(*DirectPayload))
+			case msg.Type == MessageExec:
+				go i.runExec(msg, payload.(*ExecPayload))
+			case isFileMessage(msg.Type):
+				go i.serveFile(msg, payload)
+			case isStreamMessage(msg.Type):
+				i.receiveStream(msg, payload)
+			default:
+				i.handleEvent(msg, payload)
+			}
+		}
+	}()
+
+	control := make(chan Message)
+	go func() {
+		execute := func(ctx context.Context, msg Message) (Message, error) {
+			return i.execute(ctx, msg, control)
+		}
+		if err := i.Heartbeat().Run(quit, execute, i.setLatency); err != nil {
+			log.Printf("Instance: Broker stopped answering (%v)\n", err)
+			socket.Close()
 		}
 	}()
 
+	resumed := make(chan error, 1)
+	if resume {
+		go func() {
+			resumed <- i.resume(control)
+		}()
+	} else {
+		resumed <- nil
+	}
+	i.emitConnState(ConnEvent{State: ConnConnected})
+
+	// requests queued by callers are held back until the session is resumed
+	var queue chan Message
 	for {
 		var msg Message
-		err := websocket.JSON.Receive(i.socket, &msg)
+		select {
+		case msg = <-control:
+		case msg = <-queue:
+		case err := <-resumed:
+			if errors.Is(err, ErrUnauthorized) {
+				i.emitConnState(ConnEvent{State: ConnRejected, Err: err})
+			} else if err != nil {
+				log.Printf("Instance: [Warning] Resuming session failed (%v)\n", err)
+			} else if resume {
+				i.emitConnState(ConnEvent{State: ConnResumed})
+			}
+			queue = i.send
+			continue
+		case err := <-lost:
+			return true, err
+		}
+		if err := peer.Allows(msg); err != nil {
+			// answered here, the broker would not understand it
+			msg.Reply = true
+			msg.Data = make(map[string]string)
+			msg.Fail(err)
+			i.pending.Resolve(msg)
+			continue
+		}
+		if err := websocket.JSON.Send(socket, msg); err != nil {
+			socket.Close()
+			return true, <-lost
+		}
+	}
+}
+
+func (i *Instance) resume(control chan Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ResumeTimeout)
+	defer cancel()
+
+	i.mu.RLock()
+	token, hostname := i.token, i.hostname
+	var topics []topicSubscription
+	for sub := range i.topics {
+		topics = append(topics, sub)
+	}
+	i.mu.RUnlock()
+
+	if len(token) > 0 {
+		if err := i.auth(ctx, token, control); err != nil {
+			return err
+		}
+	}
+	if len(hostname) > 0 {
+		if err := i.identify(ctx, hostname, control); err != nil {
+			return err
+		}
+	}
+	for _, sub := range topics {
+		if err := i.subscribe(ctx, sub.topic, sub.group, control); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Instance) handleEvent(msg Message, payload interface{}) {
+	state := i.State()
+	switch msg.Type {
+	case MessageEventNewGroup:
+		event := payload.(*EventPayload)
+		if _, err := state.GetGroup(event.Name); err == nil {
+			return // group exists
+		}
+		user, err := state.GetUser(event.Owner)
 		if err != nil {
-			log.Println(err)
-			break
-		}
-		if msg.Reply {
-			i.recv <- msg
-		} else {
-			switch msg.Type {
-			case MessageEventNewGroup:
-				if _, err := i.State().GetGroup(msg.Data["name"]); err == nil {
-					continue // group exists
-				}
-				user, err := i.State().GetUser(msg.Data["owner"])
-				if err != nil {
-					user, err = i.State().NewUser(msg.Data["owner"])
-					if err != nil {
-						log.Fatal("Instance: unresolvable state inconsistency", err)
-					}
-				}
-				if _, err := i.State().NewGroup(msg.Data["name"], user); err != nil {
-					log.Fatal("Instance: unresolvable state inconsistency", err)
-				}
-			case MessageEventNewUser:
-				if _, err := i.State().GetUser(msg.Data["name"]); err != nil {
-					if _, err := i.State().NewUser(msg.Data["name"]); err != nil {
-						log.Fatal("Instance: unresolvable state inconsistency", err)
-					}
-				}
-			case MessageEventNewEndpoint:
-				if _, err := i.State().GetEndpoint(msg.Data["name"]); err == nil {
-					continue // endpoint exists
-				}
-				user, err := i.State().GetUser(msg.Data["owner"])
-				if err != nil {
-					user, err = i.State().NewUser(msg.Data["owner"])
-					if err != nil {
-						log.Fatal("Instance: unresolvable state inconsistency", err)
-					}
-				}
-				if _, err := i.State().NewEndpoint(msg.Data["name"], user); err != nil {
-					log.Fatal("Instance: unresolvable state inconsistency", err)
-				}
-			case MessageEventRemoveEndpoint:
-				if endpoint, err := i.State().GetEndpoint(msg.Data["name"]); err == nil {
-					i.State().RemoveEndpoint(endpoint)
-				}
-			case MessageEventRemoveGroup:
-				if group, err := i.State().GetGroup(msg.Data["name"]); err == nil {
-					i.State().RemoveGroup(group)
-				}
-			case MessageEventRemoveUser:
-				if user, err := i.State().GetUser(msg.Data["name"]); err == nil {
-					i.State().RemoveUser(user)
-				}
-			case MessageEventEndpointOnline:
-				if endpoint, err := i.State().GetEndpoint(msg.Data["name"]); err == nil {
-					endpoint.SetStaticOnline(true)
-				}
-			case MessageEventEndpointOffline:
-				if endpoint, err := i.State().GetEndpoint(msg.Data["name"]); err == nil {
-					endpoint.SetStaticOnline(false)
-				}
-			case MessageEventGroupGroupJoin:
-				if group, err := i.State().GetGroup(msg.Data["group"]); err == nil {
-					if target, err := i.State().GetGroup(msg.Data["target"]); err == nil {
-						group.AddGroup(target)
-					}
-				}
-			case MessageEventGroupGroupLeave:
-				if group, err := i.State().GetGroup(msg.Data["group"]); err == nil {
-					if target, err := i.State().GetGroup(msg.Data["target"]); err == nil {
-						group.RemoveGroup(target)
-					}
-				}
-			case MessageEventGroupEndpointJoin:
-				if group, err := i.State().GetGroup(msg.Data["group"]); err == nil {
-					if target, err := i.State().GetEndpoint(msg.Data["target"]); err == nil {
-						group.AddEndpoint(target)
-					}
-				}
-			case MessageEventGroupEndpointLeave:
-				if group, err := i.State().GetGroup(msg.Data["group"]); err == nil {
-					if target, err := i.State().GetEndpoint(msg.Data["target"]); err == nil {
-						group.RemoveEndpoint(target)
-					}
-				}
-			default:
-				log.Fatal("Instance: unhandled event message %v\n", msg)
+			user, err = state.NewUser(event.Owner)
+			if err != nil {
+				log.Println("Instance: unresolvable state inconsistency", err)
+				return
 			}
 		}
+		if _, err := state.NewGroup(event.Name, user); err != nil {
+			log.Println("Instance: unresolvable state inconsistency", err)
+			return
+		}
+	case MessageEventNewUser:
+		event := payload.(*EventPayload)
+		if _, err := state.GetUser(event.Name); err != nil {
+			if _, err := state.NewUser(event.Name); err != nil {
+				log.Println("Instance: unresolvable state inconsistency", err)
+				return
+			}
+		}
+	case MessageEventNewEndpoint:
+		event := payload.(*EventPayload)
+		if _, err := state.GetEndpoint(event.Name); err == nil {
+			return // endpoint exists
+		}
+		user, err := state.GetUser(event.Owner)
+		if err != nil {
+			user, err = state.NewUser(event.Owner)
+			if err != nil {
+				log.Println("Instance: unresolvable state inconsistency", err)
+				return
+			}
+		}
+		if _, err := state.NewEndpoint(event.Name, user); err != nil {
+			log.Println("Instance: unresolvable state inconsistency", err)
+			return
+		}
+	case MessageEventRemoveEndpoint:
+		event := payload.(*EventPayload)
+		if endpoint, err := state.GetEndpoint(event.Name); err == nil {
+			state.RemoveEndpoint(endpoint)
+		}
+	case MessageEventRemoveGroup:
+		event := payload.(*EventPayload)
+		if group, err := state.GetGroup(event.Name); err == nil {
+			state.RemoveGroup(group)
+		}
+	case MessageEventRemoveUser:
+		event := payload.(*EventPayload)
+		if user, err := state.GetUser(event.Name); err == nil {
+			state.RemoveUser(user)
+		}
+	case MessageEventEndpointOnline:
+		event := payload.(*EventPayload)
+		if endpoint, err := state.GetEndpoint(event.Name); err == nil {
+			endpoint.SetStaticOnline(true)
+		}
+	case MessageEventEndpointOffline:
+		event := payload.(*EventPayload)
+		if endpoint, err := state.GetEndpoint(event.Name); err == nil {
+			endpoint.SetStaticOnline(false)
+		}
+	case MessageEventGroupGroupJoin:
+		event := payload.(*GroupMemberPayload)
+		if group, err := state.GetGroup(event.Group); err == nil {
+			if target, err := state.GetGroup(event.Target); err == nil {
+				group.AddGroup(target)
+			}
+		}
+	case MessageEventGroupGroupLeave:
+		event := payload.(*GroupMemberPayload)
+		if group, err := state.GetGroup(event.Group); err == nil {
+			if target, err := state.GetGroup(event.Target); err == nil {
+				group.RemoveGroup(target)
+			}
+		}
+	case MessageEventGroupEndpointJoin:
+		event := payload.(*EndpointMemberPayload)
+		if group, err := state.GetGroup(event.Group); err == nil {
+			if target, err := state.GetEndpoint(event.Endpoint); err == nil {
+				group.AddEndpoint(target)
+			}
+		}
+	case MessageEventGroupEndpointLeave:
+		event := payload.(*EndpointMemberPayload)
+		if group, err := state.GetGroup(event.Group); err == nil {
+			if target, err := state.GetEndpoint(event.Endpoint); err == nil {
+				group.RemoveEndpoint(target)
+			}
+		}
+	case MessageExecOutput:
+		i.receiveExecOutput(payload.(*ExecOutputPayload))
+	case MessagePublish:
+		event := payload.(*PublishPayload)
+		i.mu.RLock()
+		handler := i.onTopic
+		i.mu.RUnlock()
+		if handler != nil {
+			go handler(event.Topic, event.From, event.Data)
+		}
+	default:
+		log.Printf("Instance: unhandled event message %v\n", msg)
 	}
+}
 
-	return
+func (i *Instance) Send(ctx context.Context, command Message) error {
+	return i.sendOn(ctx, command, i.send)
 }
 
-func (i *Instance) Send(command Message) {
-	i.send <- command
+func (i *Instance) sendOn(ctx context.Context, command Message, queue chan Message) error {
+	select {
+	case queue <- command:
+		return nil
+	case <-i.done:
+		return &RequestError{command.Type, ErrConnectionLost}
+	case <-ctx.Done():
+		return &RequestError{command.Type, contextError(ctx)}
+	}
 }
 
-func (i *Instance) Receive() Message {
-	return <-i.recv
+func (i *Instance) Execute(ctx context.Context, command Message) (Message, error) {
+	return i.execute(ctx, command, i.send)
 }
 
-func (i *Instance) Execute(command Message) Message {
-	i.Send(command)
-	return i.Receive()
+func (i *Instance) execute(ctx context.Context, command Message, queue chan Message) (Message, error) {
+	reply := i.pending.Register(&command)
+	if err := i.sendOn(ctx, command, queue); err != nil {
+		i.pending.Cancel(command.ID)
+		return command, err
+	}
+
+	select {
+	case ret, ok := <-reply:
+		if !ok {
+			return command, &RequestError{command.Type, ErrConnectionLost}
+		}
+		return ret, nil
+	case <-ctx.Done():
+		i.pending.Cancel(command.ID)
+		return command, &RequestError{command.Type, contextError(ctx)}
+	}
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrQueued is returned for messages the broker keeps in the recipient's
+// mailbox because it is offline, they are delivered once it identifies.
+var ErrQueued = errors.New("Queued for delivery")
+
+// MailboxLimits bound each endpoint's mailbox. Messages older than TTL are
+// dropped undelivered, and no more are queued past Messages or Bytes.
+type MailboxLimits struct {
+	TTL      time.Duration
+	Messages int
+	Bytes    int
+}
+
+func DefaultMailboxLimits() MailboxLimits {
+	return MailboxLimits{TTL: 24 * time.Hour, Messages: 100, Bytes: 1 << 20}
+}
+
+func (l MailboxLimits) Valid() error {
+	if l.TTL <= 0 {
+		return errors.New("Mailbox TTL must be positive")
+	}
+	if l.Messages <= 0 || l.Bytes <= 0 {
+		return errors.New("Mailbox caps must be positive")
+	}
+	return nil
+}
+
+// A Mail is a direct or group message waiting for its recipient.
+type Mail struct {
+	ID      string
+	From    string
+	Group   string `json:",omitempty"`
+	Data    string
+	Queued  time.Time
+	Expires time.Time
+}
+
+func mailRecord(e *Endpoint, m Mail) Record {
+	raw, _ := json.Marshal(m)
+	return Record{Op: RecordMail, Name: e.Name(), Value: string(raw)}
+}
+
+// Mail returns the messages waiting for e in delivery order.
+func (e *Endpoint) Mail() []Mail {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]Mail(nil), e.mail...)
+}
+
+func (e *Endpoint) addMail(m Mail) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.mail = append(e.mail, m)
+}
+
+func (e *Endpoint) removeMail(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for n, m := range e.mail {
+		if m.ID == id {
+			e.mail = append(e.mail[:n], e.mail[n+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pruneMail drops expired messages, returning their IDs.
+func (e *Endpoint) pruneMail(now time.Time) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var expired []string
+	kept := e.mail[:0]
+	for _, m := range e.mail {
+		if now.After(m.Expires) {
+			expired = append(expired, m.ID)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	e.mail = kept
+	return expired
+}
+
+// pruneMailLocked must be called with mu held.
+func (s *State) pruneMailLocked(target *Endpoint) {
+	for _, id := range target.pruneMail(time.Now()) {
+		s.journal(Record{Op: RecordRemoveMail, Name: target.Name(), Target: id})
+	}
+}
+
+// QueueMail appends a message to target's mailbox, unless that would exceed
+// limits.
+func (s *State) QueueMail(target *Endpoint, from string, group string, data string, limits MailboxLimits) (Mail, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Mail{}, err
+	}
+	now := time.Now().UTC()
+	m := Mail{ID: hex.EncodeToString(id), From: from, Group: group, Data: data, Queued: now, Expires: now.Add(limits.TTL)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.getEndpointLocked(target.Name()); err != nil {
+		return Mail{}, err
+	}
+	s.pruneMailLocked(target)
+	queued := target.Mail()
+	size := len(data)
+	for _, waiting := range queued {
+		size += len(waiting.Data)
+	}
+	if len(queued) >= limits.Messages || size > limits.Bytes {
+		return Mail{}, &ProtocolError{CodeLimit, "Mailbox full"}
+	}
+
+	target.addMail(m)
+	s.journal(mailRecord(target, m))
+	return m, nil
+}
+
+// NextMail returns the oldest unexpired message waiting for target.
+func (s *State) NextMail(target *Endpoint) (Mail, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneMailLocked(target)
+	queued := target.Mail()
+	if len(queued) == 0 {
+		return Mail{}, false
+	}
+	return queued[0], true
+}
+
+func (s *State) HasMail(target *Endpoint) bool {
+	return len(target.Mail()) > 0
+}
+
+// RemoveMail drops a message once it was delivered.
+func (s *State) RemoveMail(target *Endpoint, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if target.removeMail(id) {
+		s.journal(Record{Op: RecordRemoveMail, Name: target.Name(), Target: id})
+	}
+}
@@ -2,10 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	prompt "github.com/c-bata/go-prompt"
@@ -82,6 +91,23 @@ type COption func(string) (string, bool)
 
 var Commands CTree
 var data map[string]string
+var commandTimeout = 10 * time.Second
+
+func commandContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), commandTimeout)
+}
+
+// transferProgress logs a transfer at every tenth of the way.
+func transferProgress(name string) FileProgress {
+	last := int64(-1)
+	return func(done int64, total int64) {
+		step := done * 10 / total
+		if step != last {
+			last = step
+			log.Printf("%v %3d%% (%v/%v bytes)\n", name, step*10, done, total)
+		}
+	}
+}
 
 func init() {
 	brokers = make(map[string]*Broker)
@@ -132,14 +158,35 @@ func init() {
 					"state": CLeaf{
 						Help: "Display current instance state",
 						Trigger: func(option COption) {
+							log.Printf("Connection: %v (rtt %v)\n", Bold(instance.ConnState()), instance.Latency())
+							if peer := instance.Peer(); peer.Protocol > 0 {
+								log.Printf("Broker: %v\n", peer)
+							}
 							instance.State().PrettyPrint()
 						},
 					},
+					"timeout": CLeaf{
+						Help:    "Set the deadline applied to instance commands waiting on the broker",
+						Options: COpthelp{"duration": "Deadline, i.e. '10s'"},
+						Trigger: func(option COption) {
+							if value, ok := option("duration"); ok {
+								if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+									commandTimeout = timeout
+									log.Printf("Command timeout set to %v\n", commandTimeout)
+								} else {
+									log.Printf("Invalid --duration: %v\n", value)
+								}
+							}
+						},
+					},
 					"connect": CLeaf{
 						Help: "Connect to a broker",
 						Options: COpthelp{
 							"broker":   "Broker address, i.e. '127.0.0.1:42069'",
 							"insecure": "Set to any value to force insecure connection (do not use in prod)",
+							"ca":       "Optional PEM file of CA certificates to trust instead of the system pool",
+							"cert":     "Optional PEM client certificate to authenticate with, see 'broker clientcert'",
+							"key":      "Optional PEM private key for --cert",
 						},
 						Trigger: func(option COption) {
 							if brokerAddr, ok := option("broker"); ok {
@@ -148,10 +195,213 @@ func init() {
 								} else {
 									instance = NewInstance(brokerAddr, true)
 								}
+								if path, ok := data["ca"]; ok {
+									pool, err := LoadCertPool(path)
+									if err != nil {
+										log.Println(err)
+										return
+									}
+									instance.SetRootCAs(pool)
+								}
+								if certFile, ok := data["cert"]; ok {
+									if keyFile, ok := option("key"); ok {
+										cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+										if err != nil {
+											log.Println(err)
+											return
+										}
+										instance.SetClientCertificate(cert)
+									} else {
+										return
+									}
+								}
+								instance.OnConnState(func(event ConnEvent) {
+									switch event.State {
+									case ConnDisconnected:
+										log.Printf("Instance: %s from %v (%v), retrying in %v\n", Yellow(event.State), brokerAddr, event.Err, event.Retry.Round(time.Millisecond))
+									case ConnResumed:
+										log.Printf("Instance: %s session with %v\n", Green(event.State), brokerAddr)
+									case ConnRejected:
+										log.Printf("Instance: Session with %v %s (%v)\n", brokerAddr, Red(event.State), event.Err)
+									case ConnClosed:
+										log.Printf("Instance: Connection to %v %s\n", brokerAddr, event.State)
+									}
+								})
+								instance.OnMessage(func(from string, payload string) {
+									log.Printf("Instance: Message from %v: %v\n", Bold(from), payload)
+								})
+								instance.OnTopic(func(topic string, from string, payload string) {
+									log.Printf("Instance: [%v] %v: %v\n", Cyan(topic), Bold(from), payload)
+								})
 								go instance.ConnectAndRecv()
 							}
 						},
 					},
+					"shell": CLeaf{
+						Help:    "Open an interactive shell on an endpoint, requires the shell permission, Ctrl-] detaches",
+						Options: COpthelp{"to": "Endpoint hostname"},
+						Trigger: func(option COption) {
+							if to, ok := option("to"); ok {
+								ctx, cancel := commandContext()
+								defer cancel()
+								code, err := instance.Shell(ctx, to, os.Stdin, os.Stdout)
+								if err != nil {
+									log.Println(err)
+									return
+								}
+								if code < 0 {
+									log.Printf("Shell on %v detached\n", to)
+								} else {
+									log.Printf("Shell on %v exited with %v\n", to, code)
+								}
+							}
+						},
+					},
+					"enableshell": CLeaf{
+						Help:    "Let other endpoints open a shell on this instance",
+						Options: COpthelp{"path": "Optional shell to run, $SHELL or /bin/sh by default"},
+						Trigger: func(option COption) {
+							if err := instance.EnableShell(data["path"]); err != nil {
+								log.Println(err)
+								return
+							}
+							log.Printf("Shell enabled, running %v\n", instance.ShellPath())
+						},
+					},
+					"disableshell": CLeaf{
+						Help: "Stop accepting new shells, running ones stay up",
+						Trigger: func(option COption) {
+							instance.DisableShell()
+							log.Println("Shell disabled")
+						},
+					},
+					"forward": CLeaf{
+						Help: "Tunnel connections to a local port to an address on an endpoint, requires the tunnel permission",
+						Options: COpthelp{
+							"local": "Local address to listen on, i.e. '127.0.0.1:8080'",
+							"to":    "Endpoint and address it dials, i.e. 'coolbox:80' or 'coolbox:10.0.0.5:80'",
+						},
+						Trigger: func(option COption) {
+							if local, ok := option("local"); ok {
+								if to, ok := option("to"); ok {
+									parts := strings.SplitN(to, ":", 2)
+									if len(parts) != 2 {
+										log.Println("Invalid --to, expected endpoint:port")
+										return
+									}
+									if err := instance.Forward(local, parts[0], parts[1]); err != nil {
+										log.Println(err)
+										return
+									}
+									log.Printf("Forwarding %v to %v\n", local, to)
+								}
+							}
+						},
+					},
+					"unforward": CLeaf{
+						Help:    "Stop forwarding a local address, open tunnels stay up",
+						Options: COpthelp{"local": "Local address as given to forward"},
+						Trigger: func(option COption) {
+							if local, ok := option("local"); ok {
+								if err := instance.Unforward(local); err != nil {
+									log.Println(err)
+									return
+								}
+								log.Printf("Stopped forwarding %v\n", local)
+							}
+						},
+					},
+					"expose": CLeaf{
+						Help:    "Let other endpoints tunnel to an address from this instance",
+						Options: COpthelp{"addr": "Address to allow, a bare port means that port on 127.0.0.1"},
+						Trigger: func(option COption) {
+							if addr, ok := option("addr"); ok {
+								if err := instance.Expose(addr); err != nil {
+									log.Println(err)
+									return
+								}
+								log.Printf("Exposed %v\n", addr)
+							}
+						},
+					},
+					"unexpose": CLeaf{
+						Help:    "Stop accepting new tunnels to an address",
+						Options: COpthelp{"addr": "Address as given to expose"},
+						Trigger: func(option COption) {
+							if addr, ok := option("addr"); ok {
+								instance.Unexpose(addr)
+								log.Printf("Unexposed %v\n", addr)
+							}
+						},
+					},
+					"tunnels": CLeaf{
+						Help: "Display forwarded and exposed addresses",
+						Trigger: func(option COption) {
+							log.Println("Forwards:")
+							for _, forward := range instance.Forwards() {
+								log.Printf("\t%v -> %v:%v\n", forward.Local, forward.To, forward.Addr)
+							}
+							log.Println("Exposed:")
+							for _, addr := range instance.Exposed() {
+								log.Printf("\t%v\n", addr)
+							}
+						},
+					},
+					"heartbeat": CLeaf{
+						Help: "Configure heartbeats to the broker, applies from the next reconnect",
+						Options: COpthelp{
+							"interval": "Optional time between pings, i.e. '15s'",
+							"timeout":  "Optional time to wait for a pong before dropping the connection",
+						},
+						Trigger: func(option COption) {
+							heartbeat := instance.Heartbeat()
+							if value, ok := data["interval"]; ok {
+								if d, err := time.ParseDuration(value); err == nil {
+									heartbeat.Interval = d
+								}
+							}
+							if value, ok := data["timeout"]; ok {
+								if d, err := time.ParseDuration(value); err == nil {
+									heartbeat.Timeout = d
+								}
+							}
+							if err := instance.SetHeartbeat(heartbeat); err != nil {
+								log.Println(err)
+								return
+							}
+							log.Printf("Heartbeat every %v, timeout %v\n", heartbeat.Interval, heartbeat.Timeout)
+						},
+					},
+					"send": CLeaf{
+						Help: "Send data to another endpoint, i.e. one of yours or in a shared group",
+						Options: COpthelp{
+							"to":   "Destination endpoint hostname",
+							"data": "Payload to deliver",
+						},
+						Trigger: func(option COption) {
+							if to, ok := option("to"); ok {
+								if payload, ok := option("data"); ok {
+									ctx, cancel := commandContext()
+									defer cancel()
+									err := instance.SendTo(ctx, to, payload)
+									if errors.Is(err, ErrQueued) {
+										log.Printf("%v is offline, queued for delivery\n", to)
+										return
+									} else if err != nil {
+										log.Println(err)
+										return
+									}
+									log.Printf("Delivered to %v\n", to)
+								}
+							}
+						},
+					},
+					"disconnect": CLeaf{
+						Help: "Close the connection to the broker and stop reconnecting",
+						Trigger: func(option COption) {
+							instance.Close()
+						},
+					},
 					"login": CLeaf{
 						Help: "Log in to broker account (not required for basic endpoint functionality)",
 						Options: COpthelp{
@@ -159,10 +409,12 @@ func init() {
 							"password": "Account password",
 						},
 						Trigger: func(option COption) {
+							ctx, cancel := commandContext()
+							defer cancel()
 							if user, ok := option("username"); ok {
 								if pw, ok := option("password"); ok {
-									if err := instance.Login(user, pw); err != nil {
-										log.Fatal(err)
+									if err := instance.Login(ctx, user, pw); err != nil {
+										log.Println(err)
 									}
 								}
 							}
@@ -171,16 +423,20 @@ func init() {
 					"logoff": CLeaf{
 						Help: "Log out of broker account (does not deauthenticate)",
 						Trigger: func(option COption) {
-							if err := instance.Logoff(); err != nil {
-								log.Fatal(err)
+							ctx, cancel := commandContext()
+							defer cancel()
+							if err := instance.Logoff(ctx); err != nil {
+								log.Println(err)
 							}
 						},
 					},
 					"deauth": CLeaf{
 						Help: "Deauthenticate the current session, this disconnects your endpoint",
 						Trigger: func(option COption) {
-							if err := instance.Deauth(); err != nil {
-								log.Fatal(err)
+							ctx, cancel := commandContext()
+							defer cancel()
+							if err := instance.Deauth(ctx); err != nil {
+								log.Println(err)
 							}
 						},
 					},
@@ -188,9 +444,11 @@ func init() {
 						Help:    "Authenticate the current session, required to connect as endpoint",
 						Options: COpthelp{"token": "Authentication token, see 'instance token'"},
 						Trigger: func(option COption) {
+							ctx, cancel := commandContext()
+							defer cancel()
 							if token, ok := option("token"); ok {
-								if err := instance.Auth(token); err != nil {
-									log.Fatal(err)
+								if err := instance.Auth(ctx, token); err != nil {
+									log.Println(err)
 								}
 							}
 						},
@@ -199,38 +457,413 @@ func init() {
 						Help:    "Identify to the network, configures the current session as endpoint",
 						Options: COpthelp{"name": "Endpoint hostname to use, has to be unique"},
 						Trigger: func(option COption) {
+							ctx, cancel := commandContext()
+							defer cancel()
 							if name, ok := option("name"); ok {
-								if err := instance.Identify(name); err != nil {
-									log.Fatal(err)
+								if err := instance.Identify(ctx, name); err != nil {
+									log.Println(err)
 								}
 							}
 						},
 					},
 				},
 				Branches: map[string]CTree{
+					"group": CTree{
+						Help: "Communicate with endpoint groups you are a member of",
+						Leaves: map[string]CLeaf{
+							"exec": CLeaf{
+								Help: "Run a command on every online endpoint of a group and summarise the results",
+								Options: COpthelp{
+									"group":   "Group name",
+									"cmd":     "Command name as allowed on the endpoints",
+									"args":    "Optional comma separated arguments, i.e. '--args=-a,-l'",
+									"timeout": "Optional time after which the command is killed on each endpoint",
+									"limit":   "Optional number of endpoints to run on at once",
+									"json":    "Set to any value to print the results as JSON",
+								},
+								Trigger: func(option COption) {
+									if name, ok := option("group"); ok {
+										if cmd, ok := option("cmd"); ok {
+											argv := []string{cmd}
+											if args, ok := data["args"]; ok && len(args) > 0 {
+												argv = append(argv, strings.Split(args, ",")...)
+											}
+											timeout := commandTimeout
+											if value, ok := data["timeout"]; ok {
+												if d, err := time.ParseDuration(value); err == nil {
+													timeout = d
+												} else {
+													log.Printf("Invalid --timeout: %v\n", err)
+													return
+												}
+											}
+											limit := GroupExecConcurrency
+											if value, ok := data["limit"]; ok {
+												if n, err := strconv.Atoi(value); err == nil && n > 0 {
+													limit = n
+												} else {
+													log.Printf("Invalid --limit: %v\n", value)
+													return
+												}
+											}
+											results, err := instance.GroupExec(context.Background(), name, argv, timeout, limit)
+											if err != nil {
+												log.Println(err)
+												return
+											}
+											if _, ok := data["json"]; ok {
+												raw, _ := json.MarshalIndent(results, "", "  ")
+												log.Println(string(raw))
+												return
+											}
+											var table strings.Builder
+											w := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+											fmt.Fprintln(w, "HOST\tSTATUS\tDURATION\tOUTPUT\tDIGEST")
+											for _, result := range results {
+												status := fmt.Sprintf("exit %v", result.ExitCode)
+												if len(result.Error) > 0 {
+													status = result.Error
+												} else if result.TimedOut {
+													status = "timed out"
+												}
+												digest := result.Digest
+												if len(digest) > 12 {
+													digest = digest[:12]
+												}
+												fmt.Fprintf(w, "%v\t%v\t%v\t%vB\t%v\n", result.Endpoint, status, result.Duration.Round(time.Millisecond), result.Output, digest)
+											}
+											w.Flush()
+											for _, line := range strings.Split(strings.TrimRight(table.String(), "\n"), "\n") {
+												log.Println(line)
+											}
+										}
+									}
+								},
+							},
+							"send": CLeaf{
+								Help: "Send data to every endpoint in a group, nested groups and member users included",
+								Options: COpthelp{
+									"name": "Group name",
+									"data": "Payload to deliver",
+								},
+								Trigger: func(option COption) {
+									if name, ok := option("name"); ok {
+										if payload, ok := option("data"); ok {
+											ctx, cancel := commandContext()
+											defer cancel()
+											status, err := instance.SendToGroup(ctx, name, payload)
+											if err != nil {
+												log.Println(err)
+												return
+											}
+											var recipients []string
+											for endpoint := range status {
+												recipients = append(recipients, endpoint)
+											}
+											sort.Strings(recipients)
+											log.Printf("Sent to %v endpoints:\n", len(recipients))
+											for _, endpoint := range recipients {
+												if err := status[endpoint]; errors.Is(err, ErrQueued) {
+													log.Printf("\t%v\t%s\n", endpoint, Yellow(DeliveryQueued))
+												} else if err != nil {
+													log.Printf("\t%v\t%s\n", endpoint, Red(err))
+												} else {
+													log.Printf("\t%v\t%s\n", endpoint, Green(DeliveryDelivered))
+												}
+											}
+										}
+									}
+								},
+							},
+						},
+					},
+					"exec": CTree{
+						Help: "Run commands on other endpoints, and allow them to run commands here",
+						Leaves: map[string]CLeaf{
+							"allow": CLeaf{
+								Help: "Allow other endpoints to run a command on this instance",
+								Options: COpthelp{
+									"command": "Command name callers use, i.e. 'uptime'",
+									"path":    "Optional executable to run for it, looked up in $PATH by default",
+								},
+								Trigger: func(option COption) {
+									if name, ok := option("command"); ok {
+										if err := instance.AllowExec(name, data["path"]); err != nil {
+											log.Println(err)
+											return
+										}
+										log.Printf("Allowed %v\n", name)
+									}
+								},
+							},
+							"deny": CLeaf{
+								Help:    "Remove a command from the allowlist",
+								Options: COpthelp{"command": "Command name"},
+								Trigger: func(option COption) {
+									if name, ok := option("command"); ok {
+										instance.DenyExec(name)
+										log.Printf("Denied %v\n", name)
+									}
+								},
+							},
+							"list": CLeaf{
+								Help: "Display the allowlist",
+								Trigger: func(option COption) {
+									names, paths := instance.ExecAllowlist()
+									log.Println("Allowed commands:")
+									for _, name := range names {
+										log.Printf("\t%v\t%v\n", name, paths[name])
+									}
+								},
+							},
+							"run": CLeaf{
+								Help: "Run a command on an endpoint, requires the exec permission through a shared group",
+								Options: COpthelp{
+									"on":      "Endpoint hostname to run on",
+									"command": "Command name as allowed on the endpoint",
+									"args":    "Optional comma separated arguments, i.e. '--args=-a,-l'",
+									"timeout": "Optional time after which the command is killed",
+								},
+								Trigger: func(option COption) {
+									if target, ok := option("on"); ok {
+										if name, ok := option("command"); ok {
+											argv := []string{name}
+											if args, ok := data["args"]; ok && len(args) > 0 {
+												argv = append(argv, strings.Split(args, ",")...)
+											}
+											timeout := commandTimeout
+											if value, ok := data["timeout"]; ok {
+												if d, err := time.ParseDuration(value); err == nil {
+													timeout = d
+												} else {
+													log.Printf("Invalid --timeout: %v\n", err)
+													return
+												}
+											}
+											ctx, cancel := context.WithTimeout(context.Background(), timeout+commandTimeout)
+											defer cancel()
+											result, err := instance.Exec(ctx, target, argv, timeout, func(stream string, output string) {
+												for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+													if stream == ExecStderr {
+														log.Printf("%v | %s\n", target, Red(line))
+													} else {
+														log.Printf("%v | %s\n", target, line)
+													}
+												}
+											})
+											if err != nil {
+												log.Println(err)
+												return
+											}
+											if result.TimedOut {
+												log.Printf("%v timed out after %v\n", name, timeout)
+											} else if result.ExitCode != 0 {
+												log.Printf("%v exited with %v\n", name, Red(result.ExitCode))
+											} else {
+												log.Printf("%v exited with %v\n", name, Green(result.ExitCode))
+											}
+										}
+									}
+								},
+							},
+						},
+					},
+					"file": CTree{
+						Help: "Transfer files to and from other endpoints, requires the file permission through a shared group",
+						Leaves: map[string]CLeaf{
+							"serve": CLeaf{
+								Help:    "Let other endpoints push to and pull from a directory on this instance",
+								Options: COpthelp{"dir": "Directory to serve"},
+								Trigger: func(option COption) {
+									if dir, ok := option("dir"); ok {
+										if err := instance.ServeFiles(dir); err != nil {
+											log.Println(err)
+											return
+										}
+										log.Printf("Serving files from %v\n", instance.FileRoot())
+									}
+								},
+							},
+							"push": CLeaf{
+								Help: "Send a file to an endpoint, resuming an interrupted push",
+								Options: COpthelp{
+									"to":     "Destination endpoint hostname",
+									"file":   "Local file",
+									"remote": "Optional path in the endpoint's served directory, the file name by default",
+								},
+								Trigger: func(option COption) {
+									if to, ok := option("to"); ok {
+										if local, ok := option("file"); ok {
+											remote := filepath.Base(local)
+											if value, ok := data["remote"]; ok {
+												remote = value
+											}
+											start := time.Now()
+											if err := instance.PushFile(context.Background(), to, local, remote, transferProgress(local)); err != nil {
+												log.Println(err)
+												return
+											}
+											log.Printf("Pushed %v to %v:%v in %v\n", local, to, remote, time.Since(start).Round(time.Millisecond))
+										}
+									}
+								},
+							},
+							"pull": CLeaf{
+								Help: "Fetch a file from an endpoint, resuming an interrupted pull",
+								Options: COpthelp{
+									"from": "Source endpoint hostname",
+									"file": "Path in the endpoint's served directory",
+									"to":   "Optional local file, the file name by default",
+								},
+								Trigger: func(option COption) {
+									if from, ok := option("from"); ok {
+										if remote, ok := option("file"); ok {
+											local := filepath.Base(remote)
+											if value, ok := data["to"]; ok {
+												local = value
+											}
+											start := time.Now()
+											if err := instance.PullFile(context.Background(), from, remote, local, transferProgress(remote)); err != nil {
+												log.Println(err)
+												return
+											}
+											log.Printf("Pulled %v:%v to %v in %v\n", from, remote, local, time.Since(start).Round(time.Millisecond))
+										}
+									}
+								},
+							},
+						},
+					},
+					"topic": CTree{
+						Help: "Publish and subscribe to topics, i.e. 'build.*.done' or 'build.#'",
+						Leaves: map[string]CLeaf{
+							"subscribe": CLeaf{
+								Help: "Subscribe to a topic, kept across reconnects",
+								Options: COpthelp{
+									"topic": "Topic or pattern, '*' matches one segment, a trailing '#' the rest",
+									"group": "Optional group to only receive publications of its endpoints from",
+								},
+								Trigger: func(option COption) {
+									if topic, ok := option("topic"); ok {
+										ctx, cancel := commandContext()
+										defer cancel()
+										if err := instance.Subscribe(ctx, topic, data["group"]); err != nil {
+											log.Println(err)
+											return
+										}
+										log.Printf("Subscribed to %v\n", topic)
+									}
+								},
+							},
+							"unsubscribe": CLeaf{
+								Help: "Remove a subscription",
+								Options: COpthelp{
+									"topic": "Topic or pattern as subscribed",
+									"group": "Optional group as subscribed",
+								},
+								Trigger: func(option COption) {
+									if topic, ok := option("topic"); ok {
+										ctx, cancel := commandContext()
+										defer cancel()
+										if err := instance.Unsubscribe(ctx, topic, data["group"]); err != nil {
+											log.Println(err)
+											return
+										}
+										log.Printf("Unsubscribed from %v\n", topic)
+									}
+								},
+							},
+							"publish": CLeaf{
+								Help: "Publish data on a topic",
+								Options: COpthelp{
+									"topic": "Topic to publish on, without wildcards",
+									"data":  "Payload to publish",
+								},
+								Trigger: func(option COption) {
+									if topic, ok := option("topic"); ok {
+										if payload, ok := option("data"); ok {
+											ctx, cancel := commandContext()
+											defer cancel()
+											n, err := instance.Publish(ctx, topic, payload)
+											if err != nil {
+												log.Println(err)
+												return
+											}
+											log.Printf("Published to %v subscribers\n", n)
+										}
+									}
+								},
+							},
+						},
+					},
 					"token": CTree{
 						Help: "Authentication token management",
 						Leaves: map[string]CLeaf{
 							"new": CLeaf{
 								Help: "Generate a new authentication token for your current user",
+								Options: COpthelp{
+									"label":    "Label to recognise this token by",
+									"ttl":      "Optional lifetime, i.e. '720h', tokens never expire by default",
+									"endpoint": "Optional endpoint hostname this token may identify as",
+								},
 								Trigger: func(option COption) {
-									if token, err := instance.NewAuthToken(); err == nil {
-										log.Printf("New auth token: %s\n", token)
-										instance.Auth(token) // TODO remove
-									} else {
-										log.Fatal(err)
+									ctx, cancel := commandContext()
+									defer cancel()
+									if label, ok := option("label"); ok {
+										var ttl time.Duration
+										if value, ok := data["ttl"]; ok {
+											var err error
+											if ttl, err = time.ParseDuration(value); err != nil {
+												log.Printf("Invalid --ttl: %v\n", err)
+												return
+											}
+										}
+										if token, err := instance.NewAuthToken(ctx, label, ttl, data["endpoint"]); err == nil {
+											log.Printf("New auth token: %s\n", token)
+											instance.Auth(ctx, token) // TODO remove
+										} else {
+											log.Println(err)
+										}
+									}
+								},
+							},
+							"list": CLeaf{
+								Help: "List authentication tokens of your current user",
+								Trigger: func(option COption) {
+									ctx, cancel := commandContext()
+									defer cancel()
+									tokens, err := instance.ListAuthTokens(ctx)
+									if err != nil {
+										log.Println(err)
+										return
+									}
+									log.Println("Tokens:")
+									for _, t := range tokens {
+										expires, used, endpoint := "never", "never", "any"
+										if !t.Expires.IsZero() {
+											expires = t.Expires.Local().Format(time.RFC3339)
+										}
+										if !t.LastUsed.IsZero() {
+											used = t.LastUsed.Local().Format(time.RFC3339)
+										}
+										if len(t.Endpoint) > 0 {
+											endpoint = t.Endpoint
+										}
+										log.Printf("\t%v\t%v\tcreated: %v\tlast used: %v\texpires: %v\tendpoint: %v\n", Bold(t.ID), t.Label, t.Created.Local().Format(time.RFC3339), used, expires, endpoint)
 									}
 								},
 							},
 							"delete": CLeaf{
 								Help:    "Revoke a previously generated authentication token",
-								Options: COpthelp{"token": "Authentication token to revoke"},
+								Options: COpthelp{"token": "Authentication token or token id to revoke"},
 								Trigger: func(option COption) {
+									ctx, cancel := commandContext()
+									defer cancel()
 									if token, ok := option("token"); ok {
-										if err := instance.DeleteAuthToken(token); err == nil {
+										if err := instance.DeleteAuthToken(ctx, token); err == nil {
 											log.Printf("Token %s deleted\n", token)
 										} else {
-											log.Fatal(err)
+											log.Println(err)
 										}
 									}
 								},
@@ -281,6 +914,209 @@ func init() {
 						Help: "Display current broker state",
 						Trigger: func(option COption) {
 							broker.State().PrettyPrint()
+							log.Println("Subscriptions:")
+							for _, sub := range broker.Topics().Snapshot() {
+								if len(sub.Group) > 0 {
+									log.Printf("\t%v\t%v (group %v)\n", sub.Endpoint, sub.Pattern, sub.Group)
+								} else {
+									log.Printf("\t%v\t%v\n", sub.Endpoint, sub.Pattern)
+								}
+							}
+							log.Println("Mailboxes:")
+							for _, endpoint := range broker.State().AllEndpoints() {
+								if mail := endpoint.Mail(); len(mail) > 0 {
+									log.Printf("\t%v\t%v queued, oldest from %v\n", endpoint.Name(), len(mail), mail[0].Queued.Local().Format(time.RFC3339))
+								}
+							}
+						},
+					},
+					"heartbeat": CLeaf{
+						Help: "Configure heartbeats to connected sessions, applies to new sessions",
+						Options: COpthelp{
+							"interval": "Optional time between pings, i.e. '15s'",
+							"timeout":  "Optional time to wait for a pong before dropping the connection",
+						},
+						Trigger: func(option COption) {
+							heartbeat := broker.Heartbeat()
+							if value, ok := data["interval"]; ok {
+								if d, err := time.ParseDuration(value); err == nil {
+									heartbeat.Interval = d
+								}
+							}
+							if value, ok := data["timeout"]; ok {
+								if d, err := time.ParseDuration(value); err == nil {
+									heartbeat.Timeout = d
+								}
+							}
+							if err := broker.SetHeartbeat(heartbeat); err != nil {
+								log.Println(err)
+								return
+							}
+							log.Printf("Heartbeat every %v, timeout %v\n", heartbeat.Interval, heartbeat.Timeout)
+						},
+					},
+					"queue": CLeaf{
+						Help: "Configure outbound queues of connected sessions, applies to new sessions",
+						Options: COpthelp{
+							"depth":   "Optional number of messages a session may have waiting",
+							"policy":  "Optional handling of a full queue: " + strings.Join(QueuePolicies, ", "),
+							"timeout": "Optional time to wait for room under the 'block' policy",
+						},
+						Trigger: func(option COption) {
+							config := broker.QueueConfig()
+							if value, ok := data["depth"]; ok {
+								if n, err := strconv.Atoi(value); err == nil {
+									config.Depth = n
+								}
+							}
+							if value, ok := data["policy"]; ok {
+								config.Policy = value
+							}
+							if value, ok := data["timeout"]; ok {
+								if d, err := time.ParseDuration(value); err == nil {
+									config.Timeout = d
+								}
+							}
+							if err := broker.SetQueueConfig(config); err != nil {
+								log.Println(err)
+								return
+							}
+							log.Printf("Queues hold %v messages, policy %v, timeout %v\n", config.Depth, config.Policy, config.Timeout)
+						},
+					},
+					"queues": CLeaf{
+						Help: "Display the outbound queue of every session",
+						Trigger: func(option COption) {
+							for _, stats := range broker.QueueStats() {
+								name := stats.Endpoint
+								if len(name) == 0 {
+									name = "-"
+								}
+								line := fmt.Sprintf("\t%v\t%v\t%v %v/%v (high %v), sent %v, dropped %v", stats.Session, name, stats.Policy, stats.Depth, stats.Capacity, stats.HighWater, stats.Sent, stats.Dropped)
+								if stats.Dropped > 0 {
+									log.Println(Yellow(line))
+								} else {
+									log.Println(line)
+								}
+							}
+						},
+					},
+					"filelimit": CLeaf{
+						Help:    "Set the largest file endpoints may transfer through the broker",
+						Options: COpthelp{"bytes": "Size limit in bytes"},
+						Trigger: func(option COption) {
+							if value, ok := option("bytes"); ok {
+								limit, err := strconv.ParseInt(value, 10, 64)
+								if err == nil {
+									err = broker.SetFileLimit(limit)
+								}
+								if err != nil {
+									log.Println(err)
+									return
+								}
+								log.Printf("File limit is %v bytes\n", limit)
+							}
+						},
+					},
+					"mailbox": CLeaf{
+						Help: "Configure mailboxes keeping messages for offline endpoints",
+						Options: COpthelp{
+							"ttl":      "Optional time after which undelivered messages are dropped, i.e. '24h'",
+							"messages": "Optional number of messages kept per endpoint",
+							"bytes":    "Optional total size of messages kept per endpoint",
+						},
+						Trigger: func(option COption) {
+							limits := broker.MailboxLimits()
+							if value, ok := data["ttl"]; ok {
+								if d, err := time.ParseDuration(value); err == nil {
+									limits.TTL = d
+								}
+							}
+							if value, ok := data["messages"]; ok {
+								if n, err := strconv.Atoi(value); err == nil {
+									limits.Messages = n
+								}
+							}
+							if value, ok := data["bytes"]; ok {
+								if n, err := strconv.Atoi(value); err == nil {
+									limits.Bytes = n
+								}
+							}
+							if err := broker.SetMailboxLimits(limits); err != nil {
+								log.Println(err)
+								return
+							}
+							log.Printf("Mailboxes keep %v messages or %v bytes for %v\n", limits.Messages, limits.Bytes, limits.TTL)
+						},
+					},
+					"clientcert": CLeaf{
+						Help: "Issue a client certificate for mutual TLS, binding a user to an endpoint hostname",
+						Options: COpthelp{
+							"cacert":   "PEM CA certificate to sign with, i.e. the one passed to 'listen --clientca'",
+							"cakey":    "PEM private key of --cacert",
+							"user":     "User the certificate authenticates as",
+							"hostname": "Endpoint hostname the certificate may identify as",
+							"cert":     "File to write the client certificate to",
+							"key":      "File to write the client private key to",
+						},
+						Trigger: func(option COption) {
+							caCert, ok1 := option("cacert")
+							caKey, ok2 := option("cakey")
+							user, ok3 := option("user")
+							hostname, ok4 := option("hostname")
+							certFile, ok5 := option("cert")
+							keyFile, ok6 := option("key")
+							if !(ok1 && ok2 && ok3 && ok4 && ok5 && ok6) {
+								return
+							}
+							certPEM, keyPEM, err := IssueClientCert(caCert, caKey, user, hostname)
+							if err != nil {
+								log.Println(err)
+								return
+							}
+							if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+								log.Println(err)
+								return
+							}
+							if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+								log.Println(err)
+								return
+							}
+							log.Printf("Issued client certificate %v for %v@%v\n", certFile, user, hostname)
+						},
+					},
+					"kdf": CLeaf{
+						Help: "Tune argon2id password hashing, existing hashes are upgraded on next login",
+						Options: COpthelp{
+							"memory":  "Optional memory cost in KiB",
+							"time":    "Optional number of passes",
+							"threads": "Optional degree of parallelism",
+						},
+						Trigger: func(option COption) {
+							params := PasswordParamsCurrent()
+							for key, target := range map[string]*uint32{"memory": &params.Memory, "time": &params.Time} {
+								if value, ok := data[key]; ok {
+									if n, err := strconv.ParseUint(value, 10, 32); err == nil {
+										*target = uint32(n)
+									} else {
+										log.Printf("Invalid --%s: %v\n", key, err)
+										return
+									}
+								}
+							}
+							if value, ok := data["threads"]; ok {
+								if n, err := strconv.ParseUint(value, 10, 8); err == nil {
+									params.Threads = uint8(n)
+								} else {
+									log.Printf("Invalid --threads: %v\n", err)
+									return
+								}
+							}
+							if err := SetPasswordParams(params); err != nil {
+								log.Println(err)
+								return
+							}
+							log.Printf("Password hashing: argon2id memory=%dKiB time=%d threads=%d\n", params.Memory, params.Time, params.Threads)
 						},
 					},
 					"statuspage": CLeaf{
@@ -290,11 +1126,43 @@ func init() {
 						},
 					},
 					"listen": CLeaf{
-						Help:    "Start broker",
-						Options: COpthelp{"address": "listen address, i.e. '127.0.0.1:42069'"},
+						Help: "Start broker",
+						Options: COpthelp{
+							"address":     "listen address, i.e. '127.0.0.1:42069'",
+							"store":       "Optional directory to persist broker state in, restored on start",
+							"cert":        "Optional PEM certificate to serve TLS with, reloaded on change",
+							"key":         "Optional PEM private key for --cert",
+							"selfsigned":  "Set to any value to generate a development certificate (written to --cert/--key if given)",
+							"clientca":    "Optional PEM file of CAs to verify client certificates against, requires TLS",
+							"requirecert": "Set to any value to reject connections without a valid client certificate",
+						},
 						Trigger: func(option COption) {
 							if listenAddr, ok := option("address"); ok {
 								broker = NewBroker(listenAddr)
+								if _, ok := data["selfsigned"]; ok {
+									if err := broker.EnableSelfSignedTLS(data["cert"], data["key"]); err != nil {
+										log.Fatal(Sprintf("%s %s", Red("Enabling TLS failed:"), err))
+									}
+								} else if certFile, ok := data["cert"]; ok {
+									if keyFile, ok := option("key"); ok {
+										if err := broker.EnableTLS(certFile, keyFile); err != nil {
+											log.Fatal(Sprintf("%s %s", Red("Enabling TLS failed:"), err))
+										}
+									} else {
+										return
+									}
+								}
+								if caFile, ok := data["clientca"]; ok {
+									_, require := data["requirecert"]
+									if err := broker.EnableClientAuth(caFile, require); err != nil {
+										log.Fatal(Sprintf("%s %s", Red("Enabling client certificates failed:"), err))
+									}
+								}
+								if path, ok := data["store"]; ok {
+									if err := broker.Persist(path); err != nil {
+										log.Fatal(Sprintf("%s %s", Red("Restoring broker state failed:"), err))
+									}
+								}
 								go broker.ListenAndServe()
 								time.Sleep(100 * time.Millisecond) // without this, when scripting broker & instance in same process, instance may be faster than broker and fail to connect
 							}
@@ -339,6 +1207,156 @@ func init() {
 								},
 							},
 						},
+						Branches: map[string]CTree{
+							"group": CTree{
+								Help: "Manage nested groups, their members become members of the outer group",
+								Leaves: map[string]CLeaf{
+									"add": CLeaf{
+										Help: "Nest a group in another group",
+										Options: COpthelp{
+											"name":  "Group to nest",
+											"group": "Group to nest it in",
+										},
+										Trigger: func(option COption) {
+											if name, ok := option("name"); ok {
+												if groupname, ok := option("group"); ok {
+													if group, err := broker.State().GetGroup(groupname); err == nil {
+														if inner, err := broker.State().GetGroup(name); err == nil && name != groupname {
+															broker.State().JoinGroup(group, inner)
+															log.Printf("Group %s nested in group %s\n", name, groupname)
+														} else {
+															log.Printf("Group %s does not exist\n", name)
+														}
+													} else {
+														log.Printf("Group %s does not exist\n", groupname)
+													}
+												}
+											}
+										},
+									},
+									"remove": CLeaf{
+										Help: "Remove a nested group from another group",
+										Options: COpthelp{
+											"name":  "Nested group to remove",
+											"group": "Group to remove it from",
+										},
+										Trigger: func(option COption) {
+											if name, ok := option("name"); ok {
+												if groupname, ok := option("group"); ok {
+													if group, err := broker.State().GetGroup(groupname); err == nil {
+														if inner, err := broker.State().GetGroup(name); err == nil {
+															broker.State().LeaveGroup(group, inner)
+															log.Printf("Group %s removed from group %s\n", name, groupname)
+														} else {
+															log.Printf("Group %s does not exist\n", name)
+														}
+													} else {
+														log.Printf("Group %s does not exist\n", groupname)
+													}
+												}
+											}
+										},
+									},
+								},
+							},
+							"permission": CTree{
+								Help: "Manage what members of a group may do on each other's endpoints",
+								Leaves: map[string]CLeaf{
+									"allow": CLeaf{
+										Help: "Grant a permission to group members, i.e. 'exec'",
+										Options: COpthelp{
+											"group":      "Group name",
+											"permission": "Permission to grant",
+										},
+										Trigger: func(option COption) {
+											if groupname, ok := option("group"); ok {
+												if perm, ok := option("permission"); ok {
+													if group, err := broker.State().GetGroup(groupname); err == nil {
+														if err := broker.State().AllowGroup(group, perm); err != nil {
+															log.Println(err)
+															return
+														}
+														log.Printf("Group %s allows %s\n", groupname, perm)
+													} else {
+														log.Printf("Group %s does not exist\n", groupname)
+													}
+												}
+											}
+										},
+									},
+									"revoke": CLeaf{
+										Help: "Revoke a permission from group members",
+										Options: COpthelp{
+											"group":      "Group name",
+											"permission": "Permission to revoke",
+										},
+										Trigger: func(option COption) {
+											if groupname, ok := option("group"); ok {
+												if perm, ok := option("permission"); ok {
+													if group, err := broker.State().GetGroup(groupname); err == nil {
+														broker.State().RevokeGroup(group, perm)
+														log.Printf("Group %s no longer allows %s\n", groupname, perm)
+													} else {
+														log.Printf("Group %s does not exist\n", groupname)
+													}
+												}
+											}
+										},
+									},
+								},
+							},
+							"endpoint": CTree{
+								Help: "Manage endpoints of a group, members see them",
+								Leaves: map[string]CLeaf{
+									"add": CLeaf{
+										Help: "Add endpoint to group",
+										Options: COpthelp{
+											"name":  "Endpoint to add",
+											"group": "Group to add endpoint to",
+										},
+										Trigger: func(option COption) {
+											if name, ok := option("name"); ok {
+												if groupname, ok := option("group"); ok {
+													if group, err := broker.State().GetGroup(groupname); err == nil {
+														if endpoint, err := broker.State().GetEndpoint(name); err == nil {
+															broker.State().JoinGroupEndpoint(group, endpoint)
+															log.Printf("Endpoint %s added to group %s\n", name, groupname)
+														} else {
+															log.Printf("Endpoint %s does not exist\n", name)
+														}
+													} else {
+														log.Printf("Group %s does not exist\n", groupname)
+													}
+												}
+											}
+										},
+									},
+									"remove": CLeaf{
+										Help: "Remove endpoint from group",
+										Options: COpthelp{
+											"name":  "Endpoint to remove",
+											"group": "Group to remove endpoint from",
+										},
+										Trigger: func(option COption) {
+											if name, ok := option("name"); ok {
+												if groupname, ok := option("group"); ok {
+													if group, err := broker.State().GetGroup(groupname); err == nil {
+														if endpoint, err := broker.State().GetEndpoint(name); err == nil {
+															broker.State().LeaveGroupEndpoint(group, endpoint)
+															log.Printf("Endpoint %s removed from group %s\n", name, groupname)
+														} else {
+															log.Printf("Endpoint %s does not exist\n", name)
+														}
+													} else {
+														log.Printf("Group %s does not exist\n", groupname)
+													}
+												}
+											}
+										},
+									},
+								},
+							},
+						},
 					},
 					"user": CTree{
 						Help: "Administrative user management",
@@ -353,7 +1371,7 @@ func init() {
 									if username, ok := option("username"); ok {
 										if password, ok := option("password"); ok {
 											if user, err := broker.State().NewUser(username); err == nil {
-												user.SetPassword(password)
+												broker.State().SetPassword(user, password)
 											} else {
 												log.Println(err)
 											}
@@ -385,7 +1403,7 @@ func init() {
 									if username, ok := option("username"); ok {
 										if password, ok := option("password"); ok {
 											if user, err := broker.State().GetUser(username); err == nil {
-												user.SetPassword(password)
+												broker.State().SetPassword(user, password)
 												log.Printf("Password for user %s changed\n", username)
 											} else {
 												log.Printf("User %s does not exist\n", username)
@@ -427,7 +1445,7 @@ func init() {
 												if groupname, ok := option("group"); ok {
 													if group, err := broker.State().GetGroup(groupname); err == nil {
 														if user, err := broker.State().GetUser(username); err == nil {
-															group.AddGroup(user.Group())
+															broker.State().JoinGroup(group, user.Group())
 															log.Printf("User %s added to group %s\n", username, groupname)
 														} else {
 															log.Printf("User %s does not exist\n", username)
@@ -450,7 +1468,7 @@ func init() {
 												if groupname, ok := option("group"); ok {
 													if group, err := broker.State().GetGroup(groupname); err == nil {
 														if user, err := broker.State().GetUser(username); err == nil {
-															group.RemoveGroup(user.Group())
+															broker.State().LeaveGroup(group, user.Group())
 															log.Printf("User %s removed from group %s\n", username, groupname)
 														} else {
 															log.Printf("User %s does not exist\n", username)
@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 const (
 	MessageLogin = iota
 	MessageAuth
@@ -20,9 +22,30 @@ const (
 	MessageEventGroupGroupLeave
 	MessageEventGroupEndpointJoin
 	MessageEventGroupEndpointLeave
+	MessageListAuthTokens
+	MessagePing
+	MessageDirect
+	MessageGroupSend
+	MessageSubscribe
+	MessageUnsubscribe
+	MessagePublish
+	MessageExec
+	MessageExecOutput
+	MessageListGroupEndpoints
+	MessageFileStat
+	MessageFileWrite
+	MessageFileRead
+	MessageFileCommit
+	MessageStreamOpen
+	MessageStreamData
+	MessageStreamWindow
+	MessageStreamClose
+	MessageStreamControl
+	MessageHello
 )
 
 type Message struct {
+	ID      uint64
 	Type    int
 	Reply   bool
 	Success bool
@@ -35,3 +58,22 @@ func NewMessage(typ int) Message {
 	msg.Data = make(map[string]string)
 	return msg
 }
+
+// Fail marks msg as a failed reply, coded after err.
+func (msg *Message) Fail(err error) {
+	msg.Success = false
+	msg.Data["code"] = errorCode(err, CodeFailed)
+	msg.Data["message"] = err.Error()
+}
+
+func (msg *Message) Failf(code string, format string, args ...interface{}) {
+	msg.Fail(&ProtocolError{code, fmt.Sprintf(format, args...)})
+}
+
+// Err returns the failure reported by a reply, nil if it succeeded.
+func (msg Message) Err() error {
+	if msg.Success {
+		return nil
+	}
+	return &ProtocolError{msg.Data["code"], msg.Data["message"]}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+type PasswordParams struct {
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+var DefaultPasswordParams = PasswordParams{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 2,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+var passwordParams = DefaultPasswordParams
+var passwordParamsMu sync.RWMutex
+
+func PasswordParamsCurrent() PasswordParams {
+	passwordParamsMu.RLock()
+	defer passwordParamsMu.RUnlock()
+	return passwordParams
+}
+
+func SetPasswordParams(params PasswordParams) error {
+	if params.Memory < 8*uint32(params.Threads) || params.Time < 1 || params.Threads < 1 {
+		return errors.New("Invalid password hashing parameters")
+	}
+	passwordParamsMu.Lock()
+	defer passwordParamsMu.Unlock()
+	passwordParams = params
+	return nil
+}
+
+// hashPassword encodes in the PHC string format used by the argon2 reference
+// implementation, i.e. $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func hashPassword(pass string, params PasswordParams) (string, error) {
+	salt := make([]byte, params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(pass), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func decodePasswordHash(hash string) (PasswordParams, []byte, []byte, error) {
+	var params PasswordParams
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("Unsupported password hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("Unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+func verifyPassword(pass string, hash string) bool {
+	params, salt, key, err := decodePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(pass), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func passwordNeedsRehash(hash string, params PasswordParams) bool {
+	current, _, _, err := decodePasswordHash(hash)
+	if err != nil {
+		return true
+	}
+	return current != params
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payloads are the fields of a message as Go structs. Each field is tagged
+// with the key it travels under in Message.Data, so the wire format stays the
+// map of strings it always was: strings as they are, bools, numbers and
+// durations in their usual text form, []byte in base64, text marshalers as
+// their text and anything else as JSON. Tag options are
+//
+//	required   the message is invalid without a non-empty value
+//	omitempty  zero values are left out
+//	inline     on a map[string]string, every key no other field claims
+//
+// Payloads implementing Valid are checked with it after decoding.
+
+type LoginPayload struct {
+	Username string `data:"username,required"`
+	Password string `data:"password"`
+}
+
+type AuthPayload struct {
+	Token string `data:"token,required"`
+}
+
+type IdentifyPayload struct {
+	Hostname string `data:"hostname,required"`
+}
+
+type NewAuthTokenPayload struct {
+	Label    string        `data:"label,omitempty"`
+	TTL      time.Duration `data:"ttl,omitempty"`
+	Endpoint string        `data:"endpoint,omitempty"`
+}
+
+type DeleteAuthTokenPayload struct {
+	Token string `data:"token,required"`
+}
+
+// EventPayload names the user, group or endpoint a state event is about.
+type EventPayload struct {
+	Name  string `data:"name,required"`
+	Owner string `data:"owner,omitempty"`
+}
+
+type GroupMemberPayload struct {
+	Group  string `data:"group,required"`
+	Target string `data:"target,required"`
+}
+
+type EndpointMemberPayload struct {
+	Group    string `data:"group,required"`
+	Endpoint string `data:"endpoint,required"`
+}
+
+// A DirectPayload is sent to the broker with To, and forwarded with From and
+// the group it was sent to, if any. Queued is set on mail that waited in the
+// recipient's mailbox.
+type DirectPayload struct {
+	To     string    `data:"to,required"`
+	From   string    `data:"from,omitempty"`
+	Group  string    `data:"group,omitempty"`
+	Queued time.Time `data:"queued,omitempty"`
+	Data   string    `data:"data"`
+}
+
+type GroupSendPayload struct {
+	Group string `data:"group,required"`
+	Data  string `data:"data"`
+}
+
+type SubscribePayload struct {
+	Topic string `data:"topic,required"`
+	Group string `data:"group,omitempty"`
+}
+
+type PublishPayload struct {
+	From  string `data:"from,omitempty"`
+	Topic string `data:"topic,required"`
+	Data  string `data:"data"`
+}
+
+type ExecPayload struct {
+	To      string        `data:"to,omitempty"`
+	From    string        `data:"from,omitempty"`
+	Argv    []string      `data:"argv,required"`
+	Timeout time.Duration `data:"timeout,omitempty"`
+	Stream  string        `data:"stream,required"`
+}
+
+func (p ExecPayload) Valid() error {
+	if len(p.Argv) == 0 {
+		return &ProtocolError{CodeInvalid, "Invalid command"}
+	}
+	return nil
+}
+
+type ExecOutputPayload struct {
+	Stream string `data:"stream,required"`
+	FD     string `data:"fd,required"`
+	Data   []byte `data:"data"`
+}
+
+type ListGroupEndpointsPayload struct {
+	Group string `data:"group,required"`
+}
+
+type FileStatPayload struct {
+	To   string `data:"to,omitempty"`
+	From string `data:"from,omitempty"`
+	Path string `data:"path,required"`
+	Mode string `data:"mode,required"`
+	Size int64  `data:"size"`
+}
+
+func (p FileStatPayload) Valid() error {
+	if p.Mode != FilePush && p.Mode != FilePull {
+		return &ProtocolError{CodeInvalid, "Invalid mode"}
+	}
+	return nil
+}
+
+type FileWritePayload struct {
+	To     string `data:"to,omitempty"`
+	From   string `data:"from,omitempty"`
+	Path   string `data:"path,required"`
+	Offset int64  `data:"offset"`
+	Data   []byte `data:"data"`
+}
+
+type FileReadPayload struct {
+	To     string `data:"to,omitempty"`
+	From   string `data:"from,omitempty"`
+	Path   string `data:"path,required"`
+	Offset int64  `data:"offset"`
+	Length int64  `data:"length,required"`
+}
+
+type FileCommitPayload struct {
+	To     string `data:"to,omitempty"`
+	From   string `data:"from,omitempty"`
+	Path   string `data:"path,required"`
+	Size   int64  `data:"size"`
+	SHA256 string `data:"sha256,required"`
+}
+
+// FileReply carries whatever a file request answers with: the offset to
+// resume a push at, size and digest of a pulled file or a chunk of it.
+type FileReply struct {
+	Offset int64  `data:"offset,omitempty"`
+	Size   int64  `data:"size,omitempty"`
+	SHA256 string `data:"sha256,omitempty"`
+	Data   []byte `data:"data,omitempty"`
+}
+
+type StreamOpenPayload struct {
+	To     string            `data:"to,omitempty"`
+	From   string            `data:"from,omitempty"`
+	Kind   string            `data:"kind,required"`
+	Stream string            `data:"stream,required"`
+	Params map[string]string `data:",inline"`
+}
+
+type StreamDataPayload struct {
+	Stream string `data:"stream,required"`
+	Data   []byte `data:"data,required"`
+}
+
+type StreamWindowPayload struct {
+	Stream string `data:"stream,required"`
+	Bytes  int    `data:"bytes,required"`
+}
+
+type StreamClosePayload struct {
+	Stream string `data:"stream,required"`
+	Half   bool   `data:"half,omitempty"`
+}
+
+type StreamControlPayload struct {
+	Stream string            `data:"stream,required"`
+	Data   map[string]string `data:",inline"`
+}
+
+var payloadTypes = map[int]interface{}{
+	MessageLogin:                   LoginPayload{},
+	MessageAuth:                    AuthPayload{},
+	MessageIdentify:                IdentifyPayload{},
+	MessageNewAuthToken:            NewAuthTokenPayload{},
+	MessageDeleteAuthToken:         DeleteAuthTokenPayload{},
+	MessageEventNewGroup:           EventPayload{},
+	MessageEventNewUser:            EventPayload{},
+	MessageEventNewEndpoint:        EventPayload{},
+	MessageEventRemoveEndpoint:     EventPayload{},
+	MessageEventRemoveGroup:        EventPayload{},
+	MessageEventRemoveUser:         EventPayload{},
+	MessageEventEndpointOnline:     EventPayload{},
+	MessageEventEndpointOffline:    EventPayload{},
+	MessageEventGroupGroupJoin:     GroupMemberPayload{},
+	MessageEventGroupGroupLeave:    GroupMemberPayload{},
+	MessageEventGroupEndpointJoin:  EndpointMemberPayload{},
+	MessageEventGroupEndpointLeave: EndpointMemberPayload{},
+	MessageDirect:                  DirectPayload{},
+	MessageGroupSend:               GroupSendPayload{},
+	MessageSubscribe:               SubscribePayload{},
+	MessageUnsubscribe:             SubscribePayload{},
+	MessagePublish:                 PublishPayload{},
+	MessageExec:                    ExecPayload{},
+	MessageExecOutput:              ExecOutputPayload{},
+	MessageListGroupEndpoints:      ListGroupEndpointsPayload{},
+	MessageFileStat:                FileStatPayload{},
+	MessageFileWrite:               FileWritePayload{},
+	MessageFileRead:                FileReadPayload{},
+	MessageFileCommit:              FileCommitPayload{},
+	MessageStreamOpen:              StreamOpenPayload{},
+	MessageStreamData:              StreamDataPayload{},
+	MessageStreamWindow:            StreamWindowPayload{},
+	MessageStreamClose:             StreamClosePayload{},
+	MessageStreamControl:           StreamControlPayload{},
+	MessageHello:                   Hello{},
+}
+
+// NewPayload returns a pointer to an empty payload for messages of type typ,
+// nil if they carry none.
+func NewPayload(typ int) interface{} {
+	proto, ok := payloadTypes[typ]
+	if !ok {
+		return nil
+	}
+	return reflect.New(reflect.TypeOf(proto)).Interface()
+}
+
+// Payload decodes the payload of a request.
+func (msg Message) Payload() (interface{}, error) {
+	payload := NewPayload(msg.Type)
+	if payload == nil {
+		return nil, nil
+	}
+	return payload, msg.Decode(payload)
+}
+
+// Validate checks a request carries a well formed payload for its type.
+func (msg Message) Validate() error {
+	_, err := msg.Payload()
+	return err
+}
+
+type payloadField struct {
+	index     int
+	key       string
+	required  bool
+	omitempty bool
+	inline    bool
+}
+
+func payloadFields(t reflect.Type) []payloadField {
+	var fields []payloadField
+	for n := 0; n < t.NumField(); n++ {
+		tag, ok := t.Field(n).Tag.Lookup("data")
+		if !ok || tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		field := payloadField{index: n, key: opts[0]}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "required":
+				field.required = true
+			case "omitempty":
+				field.omitempty = true
+			case "inline":
+				field.inline = true
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// Encode adds the fields of payload, a struct or a pointer to one, to
+// msg.Data.
+func (msg *Message) Encode(payload interface{}) {
+	if msg.Data == nil {
+		msg.Data = make(map[string]string)
+	}
+	v := reflect.Indirect(reflect.ValueOf(payload))
+	fields := payloadFields(v.Type())
+
+	claimed := make(map[string]bool)
+	for _, field := range fields {
+		if field.inline {
+			continue
+		}
+		claimed[field.key] = true
+		value := v.Field(field.index)
+		if field.omitempty && value.IsZero() {
+			continue
+		}
+		msg.Data[field.key] = encodeField(value)
+	}
+	for _, field := range fields {
+		if field.inline {
+			for key, value := range v.Field(field.index).Interface().(map[string]string) {
+				if !claimed[key] {
+					msg.Data[key] = value
+				}
+			}
+		}
+	}
+}
+
+// Decode fills payload, a pointer to a struct, from msg.Data and validates
+// it. Fields left empty decode to their zero value.
+func (msg Message) Decode(payload interface{}) error {
+	v := reflect.ValueOf(payload).Elem()
+	fields := payloadFields(v.Type())
+
+	claimed := make(map[string]bool)
+	for _, field := range fields {
+		if field.inline {
+			continue
+		}
+		claimed[field.key] = true
+		raw := msg.Data[field.key]
+		if len(raw) == 0 {
+			if field.required {
+				return &ProtocolError{CodeInvalid, "Missing field " + field.key}
+			}
+			continue
+		}
+		if err := decodeField(v.Field(field.index), raw); err != nil {
+			return &ProtocolError{CodeInvalid, "Invalid field " + field.key}
+		}
+	}
+	for _, field := range fields {
+		if field.inline {
+			rest := make(map[string]string)
+			for key, value := range msg.Data {
+				if !claimed[key] {
+					rest[key] = value
+				}
+			}
+			v.Field(field.index).Set(reflect.ValueOf(rest))
+		}
+	}
+
+	if valid, ok := payload.(interface{ Valid() error }); ok {
+		return valid.Valid()
+	}
+	return nil
+}
+
+func encodeField(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return value.String()
+	case []byte:
+		return base64.StdEncoding.EncodeToString(value)
+	case encoding.TextMarshaler:
+		text, _ := value.MarshalText()
+		return string(text)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	raw, _ := json.Marshal(v.Interface())
+	return string(raw)
+}
+
+func decodeField(v reflect.Value, raw string) error {
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		v.SetInt(int64(d))
+		return err
+	case []byte:
+		data, err := base64.StdEncoding.DecodeString(raw)
+		v.SetBytes(data)
+		return err
+	}
+	if text, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return text.UnmarshalText([]byte(raw))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		v.SetBool(b)
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		v.SetInt(n)
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		v.SetUint(n)
+		return err
+	}
+	return json.Unmarshal([]byte(raw), v.Addr().Interface())
+}
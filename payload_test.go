@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	queued := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	for _, payload := range []interface{}{
+		&DirectPayload{To: "carolbox", From: "bobbox", Queued: queued, Data: "hi"},
+		&ExecPayload{To: "carolbox", Argv: []string{"sh", "-c", "echo, done"}, Timeout: 1500 * time.Millisecond, Stream: "1"},
+		&ExecOutputPayload{Stream: "1", FD: "stdout", Data: []byte{0, 1, 2, 255}},
+		&FileStatPayload{Path: "a/b", Mode: FilePull, Size: 1 << 40},
+		&StreamClosePayload{Stream: "s", Half: true},
+		&StreamOpenPayload{To: "carolbox", Kind: "shell", Stream: "s", Params: map[string]string{"rows": "30", "cols": "100"}},
+		&Hello{Protocol: 1, Software: "test", Features: FeatureList{"exec", "topics"}},
+	} {
+		var msg Message
+		msg.Encode(payload)
+		decoded := reflect.New(reflect.TypeOf(payload).Elem()).Interface()
+		if err := msg.Decode(decoded); err != nil {
+			t.Errorf("%T: %v", payload, err)
+		} else if !reflect.DeepEqual(decoded, payload) {
+			t.Errorf("%T: decoded %+v, expected %+v", payload, decoded, payload)
+		}
+	}
+}
+
+// The keys and formats payloads travel in predate them, older peers must
+// still understand every message.
+func TestPayloadWireFormat(t *testing.T) {
+	var msg Message
+	msg.Encode(ExecPayload{To: "carolbox", Argv: []string{"echo", "hi"}, Timeout: 500 * time.Millisecond, Stream: "1"})
+	expected := map[string]string{"to": "carolbox", "argv": `["echo","hi"]`, "timeout": "500ms", "stream": "1"}
+	if !reflect.DeepEqual(msg.Data, expected) {
+		t.Errorf("exec encoded as %v, expected %v", msg.Data, expected)
+	}
+
+	msg = Message{}
+	msg.Encode(DirectPayload{To: "carolbox", Queued: time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)})
+	if msg.Data["queued"] != "2026-10-17T12:00:00Z" {
+		t.Errorf("queued encoded as %q", msg.Data["queued"])
+	}
+	if _, ok := msg.Data["from"]; ok {
+		t.Error("omitempty field encoded")
+	}
+
+	msg = Message{}
+	msg.Encode(ExecOutputPayload{Stream: "1", FD: "stdout", Data: []byte("hi")})
+	if msg.Data["data"] != "aGk=" {
+		t.Errorf("bytes encoded as %q", msg.Data["data"])
+	}
+
+	msg = Message{}
+	msg.Encode(Hello{Protocol: 1, Features: FeatureList{"topics", "exec"}})
+	if msg.Data["features"] != "topics,exec" || msg.Data["protocol"] != "1" {
+		t.Errorf("hello encoded as %v", msg.Data)
+	}
+}
+
+func TestPayloadInline(t *testing.T) {
+	msg := NewMessage(MessageStreamOpen)
+	msg.Data = map[string]string{"to": "carolbox", "kind": "shell", "stream": "s", "rows": "30"}
+	payload, err := msg.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := payload.(*StreamOpenPayload)
+	if !reflect.DeepEqual(open.Params, map[string]string{"rows": "30"}) {
+		t.Errorf("inline decoded as %v", open.Params)
+	}
+
+	// keys claimed by a field are never taken from the inline map
+	var out Message
+	out.Encode(StreamOpenPayload{Kind: "shell", Stream: "s", Params: map[string]string{"kind": "tunnel", "cols": "80"}})
+	if out.Data["kind"] != "shell" || out.Data["cols"] != "80" {
+		t.Errorf("inline encoded as %v", out.Data)
+	}
+}
+
+func TestPayloadInvalid(t *testing.T) {
+	for _, c := range []struct {
+		typ  int
+		data map[string]string
+		msg  string
+	}{
+		{MessageDirect, map[string]string{"data": "hi"}, "Missing field to"},
+		{MessageExec, map[string]string{"argv": `["echo"]`}, "Missing field stream"},
+		{MessageExec, map[string]string{"argv": "echo", "stream": "1"}, "Invalid field argv"},
+		{MessageExec, map[string]string{"argv": "[]", "stream": "1"}, "Invalid command"},
+		{MessageExec, map[string]string{"argv": `["echo"]`, "stream": "1", "timeout": "soon"}, "Invalid field timeout"},
+		{MessageFileStat, map[string]string{"path": "a", "mode": "sideways"}, "Invalid mode"},
+		{MessageFileRead, map[string]string{"path": "a", "offset": "x"}, "Invalid field offset"},
+		{MessageStreamData, map[string]string{"stream": "s", "data": "%%%"}, "Invalid field data"},
+	} {
+		msg := NewMessage(c.typ)
+		msg.Data = c.data
+		var perr *ProtocolError
+		if err := msg.Validate(); !errors.As(err, &perr) || perr.Code != CodeInvalid || perr.Error() != c.msg {
+			t.Errorf("type %v with %v: got %v, expected %q", c.typ, c.data, err, c.msg)
+		}
+	}
+
+	if payload, err := NewMessage(MessagePing).Payload(); payload != nil || err != nil {
+		t.Errorf("ping carries a payload: %v, %v", payload, err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+)
+
+// Pending correlates outgoing requests with their replies by Message.ID so
+// many requests can be in flight on one connection at the same time.
+type Pending struct {
+	mu      sync.Mutex
+	next    uint64
+	waiting map[uint64]chan Message
+	closed  bool
+}
+
+func NewPending() *Pending {
+	var p Pending
+
+	p.waiting = make(map[uint64]chan Message)
+
+	return &p
+}
+
+// Register assigns msg a fresh ID and returns the channel its reply will be
+// delivered on. The channel is closed without a value if the connection goes
+// away first.
+func (p *Pending) Register(msg *Message) chan Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reply := make(chan Message, 1)
+	if p.closed {
+		close(reply)
+		return reply
+	}
+
+	p.next++
+	msg.ID = p.next
+	p.waiting[msg.ID] = reply
+
+	return reply
+}
+
+func (p *Pending) Resolve(msg Message) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reply, ok := p.waiting[msg.ID]
+	if ok {
+		delete(p.waiting, msg.ID)
+		reply <- msg
+	}
+	return ok
+}
+
+func (p *Pending) Cancel(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.waiting, id)
+}
+
+// Reset fails every request currently waiting for a reply, i.e. because the
+// connection carrying them was lost, but keeps accepting new ones.
+func (p *Pending) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.resetLocked()
+}
+
+func (p *Pending) resetLocked() {
+	for id, reply := range p.waiting {
+		delete(p.waiting, id)
+		close(reply)
+	}
+}
+
+func (p *Pending) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.resetLocked()
+}
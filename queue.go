@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Messages to a session wait in a queue of Depth messages for its writer. The
+// policy decides what happens to a message finding the queue full: it waits
+// up to Timeout for room, pushes out the oldest queued message, or the
+// session is dropped as a slow consumer.
+const (
+	QueueBlock      = "block"
+	QueueDropOldest = "drop-oldest"
+	QueueDisconnect = "disconnect"
+)
+
+var QueuePolicies = []string{QueueBlock, QueueDropOldest, QueueDisconnect}
+
+var (
+	DefaultQueueDepth   = 256
+	DefaultQueueTimeout = 5 * time.Second
+)
+
+var ErrQueueFull = errors.New("Outbound queue full")
+
+type QueueConfig struct {
+	Depth   int
+	Policy  string
+	Timeout time.Duration
+}
+
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{DefaultQueueDepth, QueueBlock, DefaultQueueTimeout}
+}
+
+func (c QueueConfig) Valid() error {
+	if c.Depth <= 0 || c.Timeout <= 0 {
+		return errors.New("Queue depth and timeout have to be positive")
+	}
+	for _, policy := range QueuePolicies {
+		if c.Policy == policy {
+			return nil
+		}
+	}
+	return errors.New("Unknown queue policy " + c.Policy)
+}
+
+// QueueStats describes the outbound queue of one session. HighWater is the
+// deepest the queue has been, Dropped counts messages lost to the policy.
+type QueueStats struct {
+	Session   string
+	Endpoint  string
+	Policy    string
+	Depth     int
+	Capacity  int
+	HighWater int
+	Sent      uint64
+	Dropped   uint64
+}
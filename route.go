@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var DeliveryTimeout = 10 * time.Second
+
+// Per-recipient results of a group send, keyed by endpoint in the reply.
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryQueued    = "queued"
+)
+
+// deliver forwards m to target and waits for it to acknowledge.
+func (b *Broker) deliver(target *Endpoint, m Mail) error {
+	emitter := target.Emitter()
+	if emitter == nil {
+		return ErrOffline
+	}
+
+	payload := DirectPayload{To: target.Name(), From: m.From, Group: m.Group, Data: m.Data}
+	if len(m.ID) > 0 {
+		payload.Queued = m.Queued.Truncate(time.Second)
+	}
+	fwd := NewMessage(MessageDirect)
+	fwd.Encode(payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+	defer cancel()
+	reply, err := emitter.Execute(ctx, fwd)
+	if err != nil {
+		return deliveryFailed(err)
+	}
+	if !reply.Success {
+		return &refusedError{reply.Err()}
+	}
+	return nil
+}
+
+// refusedError is a delivery the recipient answered, but turned down.
+type refusedError struct {
+	err error
+}
+
+func (e *refusedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *refusedError) Unwrap() error {
+	return e.err
+}
+
+// send delivers a message right away if target is connected and has nothing
+// queued before it, and otherwise leaves it in target's mailbox. So does a
+// delivery that went unacknowledged. It returns DeliveryDelivered or
+// DeliveryQueued.
+func (b *Broker) send(from *Endpoint, target *Endpoint, group string, payload string) (string, error) {
+	if target.Connected() && !b.State().HasMail(target) {
+		var refused *refusedError
+		err := b.deliver(target, Mail{From: from.Name(), Group: group, Data: payload})
+		if err == nil {
+			return DeliveryDelivered, nil
+		} else if errors.As(err, &refused) {
+			return "", err
+		}
+	}
+
+	// senders unaware of mailboxes would take a queued message as delivered
+	if emitter := from.Emitter(); emitter == nil || !emitter.Peer().Supports(FeatureMailbox) {
+		return "", ErrOffline
+	}
+	if _, err := b.State().QueueMail(target, from.Name(), group, payload, b.MailboxLimits()); err != nil {
+		return "", err
+	}
+	if target.Connected() {
+		go b.drain(target)
+	}
+	return DeliveryQueued, nil
+}
+
+// drain delivers target's mailbox in order, removing each message once it was
+// acknowledged. It stops at the first message that could not be delivered, the
+// rest waits for the next time target identifies.
+func (b *Broker) drain(target *Endpoint) {
+	b.mu.Lock()
+	if _, ok := b.draining[target]; ok {
+		b.mu.Unlock()
+		return
+	}
+	b.draining[target] = struct{}{}
+	b.mu.Unlock()
+
+	for {
+		m, ok := b.State().NextMail(target)
+		if !ok {
+			b.mu.Lock()
+			// mail queued meanwhile found the drain still running
+			if b.State().HasMail(target) {
+				b.mu.Unlock()
+				continue
+			}
+			delete(b.draining, target)
+			b.mu.Unlock()
+			return
+		}
+
+		from, err := b.State().GetEndpoint(m.From)
+		if err != nil || !b.State().CanReach(from, target) {
+			log.Printf("Broker: Dropping queued message from %v to %v\n", m.From, target.Name())
+			b.State().RemoveMail(target, m.ID)
+			continue
+		}
+
+		var refused *refusedError
+		if err := b.deliver(target, m); errors.As(err, &refused) {
+			log.Printf("Broker: Queued message from %v refused by %v (%v)\n", m.From, target.Name(), err)
+		} else if err != nil {
+			log.Printf("Broker: Suspending delivery to %v (%v)\n", target.Name(), err)
+			b.mu.Lock()
+			delete(b.draining, target)
+			b.mu.Unlock()
+			return
+		}
+		b.State().RemoveMail(target, m.ID)
+	}
+}
+
+// route forwards a direct message to its destination endpoint and replies to
+// the sender once the destination acknowledged it, or the broker queued it.
+func (b *Broker) route(source *Emitter, from *Endpoint, msg Message, req *DirectPayload) {
+	delete(msg.Data, "data")
+
+	target, err := b.State().GetEndpoint(req.To)
+	if err != nil || !b.State().CanReach(from, target) {
+		// unreachable endpoints are reported like missing ones
+		msg.Failf(CodeNotFound, "Endpoint not found")
+		source.Send(msg)
+		return
+	}
+
+	if status, err := b.send(from, target, "", req.Data); err != nil {
+		msg.Fail(err)
+	} else {
+		msg.Data["status"] = status
+		msg.Success = true
+	}
+	source.Send(msg)
+}
+
+// routeGroup fans a message out to every endpoint in a group the sender's
+// owner belongs to, and replies with the delivery status of each of them.
+func (b *Broker) routeGroup(source *Emitter, from *Endpoint, msg Message, req *GroupSendPayload) {
+	delete(msg.Data, "data")
+
+	group, err := b.State().GetGroup(req.Group)
+	if err != nil || !b.State().Visibility(from.Owner()).Group(group.Name()) {
+		msg.Failf(CodeNotFound, "Group not found")
+		source.Send(msg)
+		return
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	status := make(map[string]string)
+	for _, target := range b.State().ExpandGroup(group) {
+		if target == from {
+			continue
+		}
+		wg.Add(1)
+		go func(target *Endpoint) {
+			defer wg.Done()
+			result, err := b.send(from, target, group.Name(), req.Data)
+			if err != nil {
+				result = fmt.Sprintf("%v", err)
+			}
+			mu.Lock()
+			status[target.Name()] = result
+			mu.Unlock()
+		}(target)
+	}
+	wg.Wait()
+
+	raw, _ := json.Marshal(status)
+	msg.Data["status"] = string(raw)
+	msg.Success = true
+	source.Send(msg)
+}
+
+// publish hands a publication to every subscribed session allowed to receive
+// it from the sender, and replies with how many that were.
+func (b *Broker) publish(source *Emitter, from *Endpoint, msg Message, req *PublishPayload) {
+	delete(msg.Data, "data")
+
+	evt := NewMessage(MessagePublish)
+	evt.Encode(PublishPayload{From: from.Name(), Topic: req.Topic, Data: req.Data})
+
+	n := 0
+	for emitter, subs := range b.Topics().Match(req.Topic) {
+		if b.mayPublish(from, subs) {
+			emitter.Post(evt)
+			n++
+		}
+	}
+
+	msg.Data["subscribers"] = strconv.Itoa(n)
+	msg.Success = true
+	source.Send(msg)
+}
+
+func (b *Broker) mayPublish(from *Endpoint, subs []Subscription) bool {
+	for _, sub := range subs {
+		if len(sub.Group) == 0 {
+			if b.State().CanReach(from, sub.Endpoint) {
+				return true
+			}
+			continue
+		}
+		group, err := b.State().GetGroup(sub.Group)
+		if err != nil {
+			continue
+		}
+		for _, member := range b.State().ExpandGroup(group) {
+			if member == from {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// An execStream relays output of a command running on source back to the
+// session that asked for it.
+type execStream struct {
+	source *Emitter
+	caller *Emitter
+	id     string
+}
+
+// routeExec forwards an exec request to an endpoint the sender holds
+// PermissionExec on, relays its output while it runs and replies with the
+// exit status.
+func (b *Broker) routeExec(source *Emitter, from *Endpoint, msg Message, req *ExecPayload) {
+	target, err := b.State().GetEndpoint(req.To)
+	if err != nil || !b.State().CanReach(from, target) {
+		msg.Failf(CodeNotFound, "Endpoint not found")
+		source.Send(msg)
+		return
+	}
+	if !b.State().Permitted(from, target, PermissionExec) {
+		log.Printf("Broker: Denied exec from %v on %v\n", from.Name(), target.Name())
+		msg.Fail(ErrForbidden)
+		source.Send(msg)
+		return
+	}
+	emitter := target.Emitter()
+	if emitter == nil {
+		msg.Fail(ErrOffline)
+		source.Send(msg)
+		return
+	}
+
+	b.mu.Lock()
+	b.nextStream++
+	stream := strconv.FormatUint(b.nextStream, 10)
+	b.streams[stream] = execStream{source: emitter, caller: source, id: req.Stream}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.streams, stream)
+		b.mu.Unlock()
+	}()
+
+	fwd := NewMessage(MessageExec)
+	fwd.Encode(ExecPayload{From: from.Name(), Argv: req.Argv, Timeout: req.Timeout, Stream: stream})
+
+	// the target enforces the timeout, this only guards against it vanishing
+	timeout := ExecTimeoutMax
+	if req.Timeout > 0 && req.Timeout < timeout {
+		timeout = req.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+DeliveryTimeout)
+	defer cancel()
+
+	delete(msg.Data, "argv")
+	if reply, err := emitter.Execute(ctx, fwd); err != nil {
+		msg.Fail(deliveryFailed(err))
+	} else if !reply.Success {
+		msg.Fail(reply.Err())
+	} else {
+		msg.Data["exit"] = reply.Data["exit"]
+		msg.Data["timedout"] = reply.Data["timedout"]
+		msg.Success = true
+	}
+	source.Send(msg)
+}
+
+// relayExecOutput passes output on to the caller, never waiting on its queue
+// for the same reason as relayStream.
+func (b *Broker) relayExecOutput(source *Emitter, output *ExecOutputPayload) {
+	b.mu.RLock()
+	stream, ok := b.streams[output.Stream]
+	b.mu.RUnlock()
+	if !ok || stream.source != source {
+		return
+	}
+
+	evt := NewMessage(MessageExecOutput)
+	evt.Encode(ExecOutputPayload{stream.id, output.FD, output.Data})
+	stream.caller.Post(evt)
+}
+
+// checkFileLimit rejects file requests that would move more than limit bytes
+// or more than a single chunk at once.
+func checkFileLimit(payload interface{}, limit int64) error {
+	tooLarge := &ProtocolError{CodeLimit, "File exceeds size limit of " + strconv.FormatInt(limit, 10) + " bytes"}
+
+	var size, offset, length int64
+	switch req := payload.(type) {
+	case *FileStatPayload:
+		if req.Mode == FilePull {
+			return nil
+		}
+		size = req.Size
+	case *FileCommitPayload:
+		size = req.Size
+	case *FileWritePayload:
+		offset, length = req.Offset, int64(len(req.Data))
+	case *FileReadPayload:
+		offset, length = req.Offset, req.Length
+	}
+
+	if size < 0 {
+		return &ProtocolError{CodeInvalid, "Invalid size"}
+	}
+	if offset < 0 {
+		return &ProtocolError{CodeInvalid, "Invalid offset"}
+	}
+	if length < 0 {
+		return &ProtocolError{CodeInvalid, "Invalid length"}
+	}
+	if length > FileChunkMax {
+		return &ProtocolError{CodeLimit, "Chunk too large"}
+	}
+	if size > limit || offset+length > limit {
+		return tooLarge
+	}
+	return nil
+}
+
+// routeFile forwards one step of a file transfer to an endpoint the sender
+// holds PermissionFile on. Every chunk passes through here, so the size limit
+// holds no matter what either side claims.
+func (b *Broker) routeFile(source *Emitter, from *Endpoint, msg Message, payload interface{}) {
+	target, err := b.State().GetEndpoint(msg.Data["to"])
+	if err != nil || !b.State().CanReach(from, target) {
+		msg.Failf(CodeNotFound, "Endpoint not found")
+		source.Send(msg)
+		return
+	}
+	if !b.State().Permitted(from, target, PermissionFile) {
+		log.Printf("Broker: Denied file transfer from %v on %v\n", from.Name(), target.Name())
+		msg.Fail(ErrForbidden)
+		source.Send(msg)
+		return
+	}
+	limit := b.FileLimit()
+	if err := checkFileLimit(payload, limit); err != nil {
+		delete(msg.Data, "data")
+		msg.Fail(err)
+		source.Send(msg)
+		return
+	}
+	emitter := target.Emitter()
+	if emitter == nil {
+		delete(msg.Data, "data")
+		msg.Fail(ErrOffline)
+		source.Send(msg)
+		return
+	}
+
+	fwd := NewMessage(msg.Type)
+	for key, value := range msg.Data {
+		fwd.Data[key] = value
+	}
+	delete(fwd.Data, "to")
+	fwd.Data["from"] = from.Name()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+	defer cancel()
+
+	msg.Data = map[string]string{"to": target.Name()}
+	reply, err := emitter.Execute(ctx, fwd)
+	if err != nil {
+		msg.Fail(deliveryFailed(err))
+	} else if !reply.Success {
+		msg.Fail(reply.Err())
+	} else if stat := new(FileReply); msg.Type == MessageFileStat && reply.Decode(stat) == nil && stat.Size > limit {
+		msg.Failf(CodeLimit, "File exceeds size limit of %v bytes", limit)
+	} else {
+		for _, key := range []string{"offset", "size", "sha256", "data"} {
+			if value, ok := reply.Data[key]; ok {
+				msg.Data[key] = value
+			}
+		}
+		msg.Success = true
+	}
+	source.Send(msg)
+}
+
+// One side of a stream as the broker sees it. The opener names its end, the
+// other end is named after the opener so the two never collide.
+type streamEnd struct {
+	emitter *Emitter
+	id      string
+}
+
+// routeStream asks an endpoint to accept a stream, given the sender holds
+// the permission its kind requires there, and pairs up both ends so their
+// traffic can be relayed.
+func (b *Broker) routeStream(source *Emitter, from *Endpoint, msg Message, req *StreamOpenPayload) {
+	target, err := b.State().GetEndpoint(req.To)
+	if err != nil || !b.State().CanReach(from, target) {
+		msg.Failf(CodeNotFound, "Endpoint not found")
+		source.Send(msg)
+		return
+	}
+	kind := req.Kind
+	perm, ok := StreamPermissions[kind]
+	if !ok {
+		msg.Failf(CodeInvalid, "Unknown stream kind: %v", kind)
+		source.Send(msg)
+		return
+	}
+	if !b.State().Permitted(from, target, perm) {
+		log.Printf("Broker: Denied %v stream from %v to %v\n", kind, from.Name(), target.Name())
+		msg.Fail(ErrForbidden)
+		source.Send(msg)
+		return
+	}
+	emitter := target.Emitter()
+	if emitter == nil {
+		msg.Fail(ErrOffline)
+		source.Send(msg)
+		return
+	}
+
+	opener := streamEnd{emitter: source, id: req.Stream}
+	remote := streamEnd{emitter: emitter, id: from.Name() + "/" + opener.id}
+	b.mu.Lock()
+	if _, ok := b.links[opener]; ok {
+		b.mu.Unlock()
+		msg.Failf(CodeInvalid, "Invalid stream")
+		source.Send(msg)
+		return
+	}
+	b.links[opener] = remote
+	b.links[remote] = opener
+	b.mu.Unlock()
+
+	fwd := NewMessage(MessageStreamOpen)
+	fwd.Encode(StreamOpenPayload{From: from.Name(), Kind: kind, Stream: remote.id, Params: req.Params})
+
+	ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+	defer cancel()
+
+	msg.Data = map[string]string{"to": target.Name(), "stream": opener.id}
+	if reply, err := emitter.Execute(ctx, fwd); err != nil {
+		msg.Fail(deliveryFailed(err))
+	} else if !reply.Success {
+		msg.Fail(reply.Err())
+	} else {
+		log.Printf("Broker: Opened %v stream from %v to %v\n", kind, from.Name(), target.Name())
+		msg.Success = true
+	}
+	if !msg.Success {
+		b.mu.Lock()
+		delete(b.links, opener)
+		delete(b.links, remote)
+		b.mu.Unlock()
+	}
+	source.Send(msg)
+}
+
+// relayStream passes stream traffic on to the other end. Flow control is
+// left to the endpoints, the broker never waits on the other end's queue,
+// which would stall everything else the sender has to say.
+func (b *Broker) relayStream(source *Emitter, msg Message) {
+	end := streamEnd{emitter: source, id: msg.Data["stream"]}
+	b.mu.Lock()
+	peer, ok := b.links[end]
+	if ok && msg.Type == MessageStreamClose && msg.Data["half"] != "true" {
+		delete(b.links, end)
+		delete(b.links, peer)
+	}
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	fwd := NewMessage(msg.Type)
+	for key, value := range msg.Data {
+		fwd.Data[key] = value
+	}
+	fwd.Data["stream"] = peer.id
+	peer.emitter.Post(fwd)
+}
+
+// closeStreams closes every stream a session is part of, telling the other
+// ends.
+func (b *Broker) closeStreams(source *Emitter) {
+	var peers []streamEnd
+	b.mu.Lock()
+	for end, peer := range b.links {
+		if end.emitter == source {
+			delete(b.links, end)
+			delete(b.links, peer)
+			peers = append(peers, peer)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, peer := range peers {
+		msg := NewMessage(MessageStreamClose)
+		msg.Encode(StreamClosePayload{Stream: peer.id})
+		peer.emitter.Post(msg)
+	}
+}
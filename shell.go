@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/term/termios"
+	"golang.org/x/sys/unix"
+)
+
+// ShellDetach ends a shell session from the local side, i.e. when the remote
+// end stopped responding. It is Ctrl-].
+const ShellDetach = 0x1d
+
+// EnableShell lets other endpoints holding PermissionShell open a shell on
+// this instance, running path. An empty path uses $SHELL or /bin/sh.
+func (i *Instance) EnableShell(path string) error {
+	if len(path) == 0 {
+		path = os.Getenv("SHELL")
+	}
+	if len(path) == 0 {
+		path = "/bin/sh"
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.shell = resolved
+	return nil
+}
+
+func (i *Instance) DisableShell() *Instance {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.shell = ""
+	return i
+}
+
+func (i *Instance) ShellPath() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.shell
+}
+
+func setWinsize(f *os.File, rows string, cols string) error {
+	r, err := strconv.ParseUint(rows, 10, 16)
+	if err != nil {
+		return err
+	}
+	c, err := strconv.ParseUint(cols, 10, 16)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetWinsize(int(f.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: uint16(r), Col: uint16(c)})
+}
+
+// acceptShell spawns the configured shell on a fresh pseudo-terminal and
+// relays it over the stream until either side is done. Its exit status is
+// sent as a control message before the stream closes.
+func (i *Instance) acceptShell(req *StreamRequest) {
+	path := i.ShellPath()
+	if len(path) == 0 {
+		log.Printf("Instance: Refusing shell for %v\n", req.From)
+		req.Reject(&ProtocolError{CodeRefused, "Shell not enabled"})
+		return
+	}
+
+	ptm, pts, err := termios.Pty()
+	if err != nil {
+		req.Reject(err)
+		return
+	}
+	defer ptm.Close()
+	setWinsize(ptm, req.Params["rows"], req.Params["cols"])
+
+	cmd := exec.Command(path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = pts, pts, pts
+	cmd.Env = os.Environ()
+	if term := req.Params["term"]; len(term) > 0 {
+		cmd.Env = append(cmd.Env, "TERM="+term)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	err = cmd.Start()
+	pts.Close()
+	if err != nil {
+		req.Reject(err)
+		return
+	}
+
+	s := req.Accept()
+	log.Printf("Instance: Shell %v for %v started\n", path, req.From)
+	s.OnControl(func(data map[string]string) {
+		if _, ok := data["rows"]; ok {
+			setWinsize(ptm, data["rows"], data["cols"])
+		}
+	})
+
+	go func() {
+		io.Copy(ptm, s)
+		// the caller is gone, hang up on the whole session
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+	}()
+	// reading the master fails once every process let go of the terminal
+	io.Copy(s, ptm)
+	cmd.Wait()
+
+	log.Printf("Instance: Shell for %v exited with %v\n", req.From, cmd.ProcessState.ExitCode())
+	s.Control(map[string]string{"exit": strconv.Itoa(cmd.ProcessState.ExitCode())})
+	s.CloseWrite()
+	s.Close()
+}
+
+// Shell opens a shell on the endpoint to and attaches it to the terminal
+// tty, which is put into raw mode meanwhile. It returns the remote exit
+// status, or -1 if the session ended otherwise.
+func (i *Instance) Shell(ctx context.Context, to string, tty *os.File, out io.Writer) (int, error) {
+	fd := int(tty.Fd())
+	saved, err := termios.Tcgetattr(uintptr(fd))
+	if err != nil {
+		return -1, errors.New("Not a terminal")
+	}
+
+	params := map[string]string{"term": os.Getenv("TERM"), "rows": "24", "cols": "80"}
+	if ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+		params["rows"] = strconv.Itoa(int(ws.Row))
+		params["cols"] = strconv.Itoa(int(ws.Col))
+	}
+
+	s, err := i.OpenStream(ctx, to, StreamShell, params)
+	if err != nil {
+		return -1, err
+	}
+	defer s.Close()
+
+	exit := make(chan int, 1)
+	s.OnControl(func(data map[string]string) {
+		if value, ok := data["exit"]; ok {
+			code, _ := strconv.Atoi(value)
+			select {
+			case exit <- code:
+			default:
+			}
+		}
+	})
+
+	raw := *saved
+	termios.Cfmakeraw(&raw)
+	if err := termios.Tcsetattr(uintptr(fd), termios.TCSANOW, &raw); err != nil {
+		return -1, err
+	}
+	defer termios.Tcsetattr(uintptr(fd), termios.TCSANOW, saved)
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(out, s)
+		close(done)
+	}()
+
+	// polled rather than read in the background, a pending read would eat
+	// the first keystroke meant for the prompt once we are done
+	buf := make([]byte, StreamChunkSize)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-done:
+			select {
+			case code := <-exit:
+				return code, nil
+			default:
+				return -1, nil
+			}
+		case <-winch:
+			if ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+				s.Control(map[string]string{"rows": strconv.Itoa(int(ws.Row)), "cols": strconv.Itoa(int(ws.Col))})
+			}
+		default:
+		}
+
+		n, err := unix.Poll(fds, 100)
+		if err != nil && err != unix.EINTR {
+			return -1, err
+		}
+		if n == 0 {
+			continue
+		}
+		n, err = unix.Read(fd, buf)
+		if err != nil || n == 0 {
+			return -1, err
+		}
+		for j := 0; j < n; j++ {
+			if buf[j] == ShellDetach {
+				s.Write(buf[:j])
+				return -1, nil
+			}
+		}
+		if _, err := s.Write(buf[:n]); err != nil {
+			<-done
+			return -1, nil
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// A StateSnapshot is a point-in-time copy of the State graph that can be
+// read without holding any locks, i.e. by the status page template.
+type StateSnapshot struct {
+	Users        []UserSnapshot
+	PureGroups   []GroupSnapshot
+	AllEndpoints []EndpointSnapshot
+}
+
+type UserSnapshot struct {
+	Name      string
+	Endpoints []EndpointSnapshot
+}
+
+type GroupSnapshot struct {
+	Name        string
+	Owner       string
+	Groups      []GroupMemberSnapshot
+	Endpoints   []EndpointSnapshot
+	Permissions []string
+}
+
+type GroupMemberSnapshot struct {
+	Name string
+	User bool
+}
+
+type EndpointSnapshot struct {
+	Name    string
+	Owner   string
+	Online  bool
+	Latency time.Duration
+}
+
+func snapshotEndpoint(e *Endpoint) EndpointSnapshot {
+	return EndpointSnapshot{
+		Name:    e.Name(),
+		Owner:   e.Owner().Name(),
+		Online:  e.Online(),
+		Latency: e.Latency(),
+	}
+}
+
+func snapshotUser(u *User) UserSnapshot {
+	ret := UserSnapshot{Name: u.Name()}
+	for _, endpoint := range u.Endpoints() {
+		ret.Endpoints = append(ret.Endpoints, snapshotEndpoint(endpoint))
+	}
+	sortEndpointSnapshots(ret.Endpoints)
+	return ret
+}
+
+func snapshotGroup(g *Group, users map[*User]struct{}) GroupSnapshot {
+	ret := GroupSnapshot{Name: g.Name(), Owner: g.Owner().Name(), Permissions: g.Permissions()}
+	for _, inner := range g.Groups() {
+		member := GroupMemberSnapshot{Name: inner.Name()}
+		for user, _ := range users {
+			if user.Group() == inner {
+				member.User = true
+			}
+		}
+		ret.Groups = append(ret.Groups, member)
+	}
+	for _, endpoint := range g.Endpoints() {
+		ret.Endpoints = append(ret.Endpoints, snapshotEndpoint(endpoint))
+	}
+	sort.Slice(ret.Groups, func(i, j int) bool {
+		return ret.Groups[i].Name < ret.Groups[j].Name
+	})
+	sortEndpointSnapshots(ret.Endpoints)
+	return ret
+}
+
+func sortEndpointSnapshots(endpoints []EndpointSnapshot) {
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Name < endpoints[j].Name
+	})
+}
+
+func (s *StateSnapshot) sort() {
+	sort.Slice(s.Users, func(i, j int) bool {
+		return s.Users[i].Name < s.Users[j].Name
+	})
+	sort.Slice(s.PureGroups, func(i, j int) bool {
+		return s.PureGroups[i].Name < s.PureGroups[j].Name
+	})
+	sortEndpointSnapshots(s.AllEndpoints)
+}
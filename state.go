@@ -1,13 +1,24 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
+// State guards its user set and every multi-step graph mutation with mu,
+// Groups, Users and Endpoints additionally lock their own fields so lookups
+// can run without holding the State lock. Broadcasts are always sent after
+// mu is released so a slow peer never blocks other mutations, and only to
+// sessions whose Visibility covers what they are about.
 type State struct {
+	mu    sync.RWMutex
 	users map[*User]struct{}
 	root  *Group
+
+	store *Store
 }
 
 func NewState() *State {
@@ -19,63 +30,127 @@ func NewState() *State {
 	return &s
 }
 
-func (s *State) Broadcast(msg Message) {
-	for _, endpoint := range s.AllEndpoints() {
-		if endpoint.Connected() {
-			endpoint.Emitter().Send(msg)
-		}
+func (s *State) Store() *Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store
+}
+
+func (s *State) SetStore(st *Store) error {
+	if err := st.Load(s); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := st.Compact(s.recordsLocked()); err != nil {
+		return err
 	}
+	s.store = st
+	return nil
 }
 
-func (s *State) PushState(e *Emitter) {
-	for _, user := range s.Users() {
-		e.Send(s.NotifyNewUser(user.Name()))
+// journal must be called with mu held so records land in mutation order
+func (s *State) journal(rec Record) {
+	if s.store == nil {
+		return
 	}
-	for _, endpoint := range s.AllEndpoints() {
-		e.Send(s.NotifyNewEndpoint(endpoint.Name(), endpoint.Owner().Name()))
+	if err := s.store.Append(rec); err != nil {
+		log.Printf("State: [Warning] Failed to journal %v (%v)\n", rec.Op, err)
+		return
 	}
-	for _, group := range s.PureGroups() {
-		e.Send(s.NotifyNewGroup(group.Name(), group.Owner().Name()))
-		for _, inner := range group.Groups() {
-			e.Send(s.NotifyGroupGroupJoin(group.Name(), inner.Name()))
+	if s.store.NeedsCompaction() {
+		if err := s.store.Compact(s.recordsLocked()); err != nil {
+			log.Printf("State: [Warning] Failed to compact store (%v)\n", err)
 		}
-		for _, inner := range group.Endpoints() {
-			e.Send(s.NotifyGroupEndpointJoin(group.Name(), inner.Name()))
+	}
+}
+
+func (s *State) Broadcast(msg Message) {
+	s.mu.RLock()
+	views := s.viewsLocked()
+	s.mu.RUnlock()
+
+	for emitter, view := range views {
+		if view.Allows(msg) {
+			emitter.Post(msg)
 		}
 	}
 }
 
+// PushState sends the part of the graph user may see.
+func (s *State) PushState(e *Emitter, user *User) {
+	if user == nil {
+		return
+	}
+	for _, msg := range s.viewEvents(newVisibility(), s.Visibility(user)) {
+		e.Send(msg)
+	}
+}
+
 func (s *State) PrettyPrint() {
+	snapshot := s.Snapshot()
 	log.Println("==== STATE")
 	log.Println("Users:")
-	for _, user := range s.Users() {
-		log.Printf("\t%v\n", user.Name())
-		for _, endpoint := range user.Endpoints() {
-			log.Printf("\t... endpoint: %v (online? %v)\n", endpoint.Name(), endpoint.Online())
+	for _, user := range snapshot.Users {
+		log.Printf("\t%v\n", user.Name)
+		for _, endpoint := range user.Endpoints {
+			if endpoint.Latency > 0 {
+				log.Printf("\t... endpoint: %v (online? %v, rtt %v)\n", endpoint.Name, endpoint.Online, endpoint.Latency)
+			} else {
+				log.Printf("\t... endpoint: %v (online? %v)\n", endpoint.Name, endpoint.Online)
+			}
 		}
 	}
 	log.Println("Groups:")
-	for _, group := range s.PureGroups() {
-		log.Printf("\t%v\n", group.Name())
-		for _, inner := range group.Groups() {
-			if _, err := s.GetUser(inner.Name()); err == nil {
-				log.Printf("\t... member user: %v\n", inner.Name())
+	for _, group := range snapshot.PureGroups {
+		log.Printf("\t%v\n", group.Name)
+		for _, inner := range group.Groups {
+			if inner.User {
+				log.Printf("\t... member user: %v\n", inner.Name)
 			} else {
-				log.Printf("\t... member group: %v\n", inner.Name())
+				log.Printf("\t... member group: %v\n", inner.Name)
 			}
 		}
-		for _, endpoint := range group.Endpoints() {
-			log.Printf("\t... member endpoint: %v\n", endpoint.Name())
+		for _, endpoint := range group.Endpoints {
+			log.Printf("\t... member endpoint: %v\n", endpoint.Name)
+		}
+		for _, perm := range group.Permissions {
+			log.Printf("\t... permission: %v\n", perm)
 		}
 	}
 	log.Println("====")
 }
 
+func (s *State) Snapshot() *StateSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ret StateSnapshot
+	for _, user := range s.usersLocked() {
+		ret.Users = append(ret.Users, snapshotUser(user))
+	}
+	for _, group := range s.pureGroupsLocked() {
+		ret.PureGroups = append(ret.PureGroups, snapshotGroup(group, s.users))
+	}
+	for _, endpoint := range s.allEndpointsLocked() {
+		ret.AllEndpoints = append(ret.AllEndpoints, snapshotEndpoint(endpoint))
+	}
+	ret.sort()
+
+	return &ret
+}
+
 func (s *State) Root() *Group {
 	return s.root
 }
 
 func (s *State) Users() []*User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.usersLocked()
+}
+
+func (s *State) usersLocked() []*User {
 	var ret []*User
 	for user, _ := range s.users {
 		ret = append(ret, user)
@@ -88,11 +163,16 @@ func (s *State) Groups() []*Group {
 }
 
 func (s *State) PureGroups() []*Group {
-	users := s.Users()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pureGroupsLocked()
+}
+
+func (s *State) pureGroupsLocked() []*Group {
 	var ret []*Group
 	for _, group := range s.Groups() {
 		usergroup := false
-		for _, user := range users {
+		for user, _ := range s.users {
 			if user.Name() == group.Name() {
 				usergroup = true
 			}
@@ -105,12 +185,18 @@ func (s *State) PureGroups() []*Group {
 }
 
 func (s *State) GetUser(name string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getUserLocked(name)
+}
+
+func (s *State) getUserLocked(name string) (*User, error) {
 	for user, _ := range s.users {
 		if user.Name() == name {
 			return user, nil
 		}
 	}
-	return nil, errors.New("User not found")
+	return nil, &ProtocolError{CodeNotFound, "User not found"}
 }
 
 func (s *State) GetUserGroups(user *User) []*Group {
@@ -128,16 +214,28 @@ func (s *State) GetGroup(name string) (*Group, error) {
 }
 
 func (s *State) GetEndpoint(name string) (*Endpoint, error) {
-	for _, endpoint := range s.AllEndpoints() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getEndpointLocked(name)
+}
+
+func (s *State) getEndpointLocked(name string) (*Endpoint, error) {
+	for _, endpoint := range s.allEndpointsLocked() {
 		if endpoint.Name() == name {
 			return endpoint, nil
 		}
 	}
-	return nil, errors.New("Endpoint not found")
+	return nil, &ProtocolError{CodeNotFound, "Endpoint not found"}
 }
 
 func (s *State) NameUsed(name string) bool {
-	for _, endpoint := range s.AllEndpoints() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.nameUsedLocked(name)
+}
+
+func (s *State) nameUsedLocked(name string) bool {
+	for _, endpoint := range s.allEndpointsLocked() {
 		if endpoint.Name() == name {
 			return true
 		}
@@ -151,6 +249,12 @@ func (s *State) NameUsed(name string) bool {
 }
 
 func (s *State) AllEndpoints() []*Endpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.allEndpointsLocked()
+}
+
+func (s *State) allEndpointsLocked() []*Endpoint {
 	all := make(map[*Endpoint]struct{})
 
 	for _, endpoint := range s.Root().Endpoints() {
@@ -169,138 +273,492 @@ func (s *State) AllEndpoints() []*Endpoint {
 	return ret
 }
 
-func (s *State) NewUser(name string) (*User, error) {
-	if s.NameUsed(name) {
-		return nil, errors.New("Name in use")
+// ExpandGroup returns every endpoint in group, in its nested groups and of
+// its member users.
+func (s *State) ExpandGroup(group *Group) []*Endpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make(map[*Endpoint]struct{})
+	s.expandGroupLocked(group, all, make(map[*Group]struct{}))
+
+	var ret []*Endpoint
+	for endpoint := range all {
+		ret = append(ret, endpoint)
+	}
+	return ret
+}
+
+func (s *State) expandGroupLocked(group *Group, all map[*Endpoint]struct{}, seen map[*Group]struct{}) {
+	if _, ok := seen[group]; ok {
+		return
+	}
+	seen[group] = struct{}{}
+
+	for _, endpoint := range group.Endpoints() {
+		all[endpoint] = struct{}{}
+	}
+	for _, inner := range group.Groups() {
+		if user := s.groupUserLocked(inner); user != nil {
+			// a user group also holds the groups its user owns, only take endpoints
+			for _, endpoint := range user.Endpoints() {
+				all[endpoint] = struct{}{}
+			}
+		} else {
+			s.expandGroupLocked(inner, all, seen)
+		}
 	}
+}
 
-	u := NewUser(name)
-	s.users[u] = struct{}{}
-	s.Root().AddGroup(u.Group())
+func (s *State) NewUser(name string) (*User, error) {
+	var u *User
+	var err error
+	s.mutate(func() {
+		if s.nameUsedLocked(name) {
+			err = &ProtocolError{CodeNameInUse, "Name in use"}
+			return
+		}
 
-	s.Broadcast(s.NotifyNewUser(name))
+		u = NewUser(name)
+		s.users[u] = struct{}{}
+		s.Root().AddGroup(u.Group())
 
-	return u, nil
+		s.journal(Record{Op: RecordUser, Name: name})
+	})
+	return u, err
 }
 
 func (s *State) NotifyNewUser(name string) Message {
 	msg := NewMessage(MessageEventNewUser)
-	msg.Data["name"] = name
+	msg.Encode(EventPayload{Name: name})
 	return msg
 }
 
 func (s *State) NewGroup(name string, owner *User) (*Group, error) {
-	if s.NameUsed(name) {
-		return nil, errors.New("Name in use")
-	}
-
-	g := NewGroup(name)
-	g.SetOwner(owner)
-	s.Root().AddGroup(g)
+	var g *Group
+	var err error
+	s.mutate(func() {
+		if s.nameUsedLocked(name) {
+			err = &ProtocolError{CodeNameInUse, "Name in use"}
+			return
+		}
 
-	s.Broadcast(s.NotifyNewGroup(name, owner.Name()))
+		g = NewGroup(name)
+		g.SetOwner(owner)
+		s.Root().AddGroup(g)
 
-	return g, nil
+		s.journal(Record{Op: RecordGroup, Name: name, Owner: owner.Name()})
+	})
+	return g, err
 }
 
 func (s *State) NotifyNewGroup(name string, owner string) Message {
 	msg := NewMessage(MessageEventNewGroup)
-	msg.Data["name"] = name
-	msg.Data["owner"] = owner
+	msg.Encode(EventPayload{Name: name, Owner: owner})
 	return msg
 }
 
 func (s *State) NewEndpoint(name string, owner *User) (*Endpoint, error) {
-	if s.NameUsed(name) {
-		return nil, errors.New("Name in use")
-	}
-
-	e := NewEndpoint(name)
-	e.SetOwner(owner)
+	var e *Endpoint
+	var err error
+	s.mutate(func() {
+		if s.nameUsedLocked(name) {
+			err = &ProtocolError{CodeNameInUse, "Name in use"}
+			return
+		}
 
-	s.Broadcast(s.NotifyNewEndpoint(name, owner.Name()))
+		e = NewEndpoint(name)
+		e.SetOwner(owner)
 
-	return e, nil
+		s.journal(Record{Op: RecordEndpoint, Name: name, Owner: owner.Name()})
+	})
+	return e, err
 }
 
 func (s *State) NotifyNewEndpoint(name string, owner string) Message {
 	msg := NewMessage(MessageEventNewEndpoint)
-	msg.Data["name"] = name
-	msg.Data["owner"] = owner
+	msg.Encode(EventPayload{Name: name, Owner: owner})
 	return msg
 }
 
 func (s *State) RemoveEndpoint(target *Endpoint) {
+	s.mutate(func() {
+		s.removeEndpointLocked(target)
+	})
+}
+
+func (s *State) removeEndpointLocked(target *Endpoint) {
 	for _, group := range s.Root().Groups() {
 		group.RemoveEndpoint(target)
 	}
 
-	s.Broadcast(s.NotifyRemoveEndpoint(target.Name()))
+	s.journal(Record{Op: RecordRemoveEndpoint, Name: target.Name()})
 }
 
 func (s *State) NotifyRemoveEndpoint(name string) Message {
 	msg := NewMessage(MessageEventRemoveEndpoint)
-	msg.Data["name"] = name
+	msg.Encode(EventPayload{Name: name})
 	return msg
 }
 
 func (s *State) RemoveGroup(target *Group) {
-	for _, group := range s.Root().Groups() {
-		group.RemoveGroup(target)
-	}
-	s.Root().RemoveGroup(target)
+	s.mutate(func() {
+		for _, group := range s.Root().Groups() {
+			group.RemoveGroup(target)
+		}
+		s.Root().RemoveGroup(target)
 
-	s.Broadcast(s.NotifyRemoveGroup(target.Name()))
+		s.journal(Record{Op: RecordRemoveGroup, Name: target.Name()})
+	})
 }
 
 func (s *State) NotifyRemoveGroup(name string) Message {
 	msg := NewMessage(MessageEventRemoveGroup)
-	msg.Data["name"] = name
+	msg.Encode(EventPayload{Name: name})
 	return msg
 }
 
 func (s *State) RemoveUser(target *User) {
-	for _, endpoint := range target.Endpoints() {
-		s.RemoveEndpoint(endpoint)
-	}
-	for _, group := range s.Root().Groups() {
-		group.RemoveGroup(target.Group())
-	}
-	delete(s.users, target)
+	s.mutate(func() {
+		for _, endpoint := range target.Endpoints() {
+			s.removeEndpointLocked(endpoint)
+		}
+		for _, group := range s.Root().Groups() {
+			group.RemoveGroup(target.Group())
+		}
+		s.Root().RemoveGroup(target.Group())
+		delete(s.users, target)
 
-	s.Broadcast(s.NotifyRemoveUser(target.Name()))
+		s.journal(Record{Op: RecordRemoveUser, Name: target.Name()})
+	})
 }
 
 func (s *State) NotifyRemoveUser(name string) Message {
 	msg := NewMessage(MessageEventRemoveUser)
-	msg.Data["name"] = name
+	msg.Encode(EventPayload{Name: name})
 	return msg
 }
 
+func (s *State) SetPassword(user *User, pass string) {
+	user.SetPassword(pass)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal(Record{Op: RecordPassword, Name: user.Name(), Value: user.PasswordHash()})
+}
+
+// Authenticate checks pass against the password of user. A hash of outdated
+// parameters is replaced with one of the current ones once pass turned out
+// right.
+func (s *State) Authenticate(user *User, pass string) bool {
+	if !user.CheckPassword(pass) {
+		return false
+	}
+	if user.PasswordNeedsRehash() {
+		log.Printf("State: Rehashing password for %v\n", user.Name())
+		s.SetPassword(user, pass)
+	}
+	return true
+}
+
+func (s *State) NewToken(user *User, label string, ttl time.Duration, endpoint string) (string, *Token, error) {
+	token, t, err := user.NewToken(label, ttl, endpoint)
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal(tokenRecord(user, *t))
+
+	return token, t, nil
+}
+
+func (s *State) UseToken(user *User, t Token) {
+	at := time.Now().UTC()
+	if err := user.TouchToken(t.ID, at); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal(Record{Op: RecordTouchToken, Name: user.Name(), Target: t.ID, Value: at.Format(time.RFC3339Nano)})
+}
+
+func (s *State) RemoveToken(user *User, id string) {
+	user.RemoveToken(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal(Record{Op: RecordRemoveToken, Name: user.Name(), Target: id})
+}
+
+func tokenRecord(user *User, t Token) Record {
+	raw, _ := json.Marshal(t)
+	return Record{Op: RecordToken, Name: user.Name(), Value: string(raw)}
+}
+
+// JoinGroup also reveals the group and its members to target's users.
+func (s *State) JoinGroup(group *Group, target *Group) {
+	s.mutate(func() {
+		group.AddGroup(target)
+
+		s.journal(Record{Op: RecordJoinGroup, Name: group.Name(), Target: target.Name()})
+	})
+}
+
+// LeaveGroup also withdraws whatever target's users could only see through
+// group.
+func (s *State) LeaveGroup(group *Group, target *Group) {
+	s.mutate(func() {
+		group.RemoveGroup(target)
+
+		s.journal(Record{Op: RecordLeaveGroup, Name: group.Name(), Target: target.Name()})
+	})
+}
+
+func (s *State) JoinGroupEndpoint(group *Group, target *Endpoint) {
+	s.mutate(func() {
+		group.AddEndpoint(target)
+
+		s.journal(Record{Op: RecordJoinEndpoint, Name: group.Name(), Target: target.Name()})
+	})
+}
+
+func (s *State) LeaveGroupEndpoint(group *Group, target *Endpoint) {
+	s.mutate(func() {
+		group.RemoveEndpoint(target)
+
+		s.journal(Record{Op: RecordLeaveEndpoint, Name: group.Name(), Target: target.Name()})
+	})
+}
+
+func (s *State) AllowGroup(group *Group, perm string) error {
+	if err := validPermission(perm); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group.Allow(perm)
+	s.journal(Record{Op: RecordAllow, Name: group.Name(), Value: perm})
+	return nil
+}
+
+func (s *State) RevokeGroup(group *Group, perm string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group.Revoke(perm)
+	s.journal(Record{Op: RecordRevoke, Name: group.Name(), Value: perm})
+}
+
+// Permitted reports whether from may use perm on to: both have the same
+// owner, or both are in a group granting perm, the group's owner counting as
+// a member for this.
+func (s *State) Permitted(from *Endpoint, to *Endpoint, perm string) bool {
+	if from.Owner() == to.Owner() {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, group := range s.pureGroupsLocked() {
+		if !group.Allowed(perm) {
+			continue
+		}
+		all := make(map[*Endpoint]struct{})
+		s.expandGroupLocked(group, all, make(map[*Group]struct{}))
+		_, fromIn := all[from]
+		_, toIn := all[to]
+		if toIn && (fromIn || group.Owner() == from.Owner()) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *State) NotifyGroupGroupJoin(group string, target string) Message {
 	msg := NewMessage(MessageEventGroupGroupJoin)
-	msg.Data["group"] = group
-	msg.Data["target"] = target
+	msg.Encode(GroupMemberPayload{Group: group, Target: target})
 	return msg
 }
 
 func (s *State) NotifyGroupGroupLeave(group string, target string) Message {
 	msg := NewMessage(MessageEventGroupGroupLeave)
-	msg.Data["group"] = group
-	msg.Data["target"] = target
+	msg.Encode(GroupMemberPayload{Group: group, Target: target})
 	return msg
 }
 
 func (s *State) NotifyGroupEndpointJoin(group string, endpoint string) Message {
 	msg := NewMessage(MessageEventGroupEndpointJoin)
-	msg.Data["group"] = group
-	msg.Data["endpoint"] = endpoint
+	msg.Encode(EndpointMemberPayload{Group: group, Endpoint: endpoint})
 	return msg
 }
 
 func (s *State) NotifyGroupEndpointLeave(group string, endpoint string) Message {
 	msg := NewMessage(MessageEventGroupEndpointLeave)
-	msg.Data["group"] = group
-	msg.Data["endpoint"] = endpoint
+	msg.Encode(EndpointMemberPayload{Group: group, Endpoint: endpoint})
 	return msg
 }
+
+func (s *State) Records() []Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.recordsLocked()
+}
+
+func (s *State) recordsLocked() []Record {
+	var ret []Record
+	for _, user := range s.usersLocked() {
+		ret = append(ret, Record{Op: RecordUser, Name: user.Name()})
+		if len(user.PasswordHash()) > 0 {
+			ret = append(ret, Record{Op: RecordPassword, Name: user.Name(), Value: user.PasswordHash()})
+		}
+		for _, t := range user.Tokens() {
+			ret = append(ret, tokenRecord(user, t))
+		}
+	}
+	for _, group := range s.pureGroupsLocked() {
+		ret = append(ret, Record{Op: RecordGroup, Name: group.Name(), Owner: group.Owner().Name()})
+		for _, perm := range group.Permissions() {
+			ret = append(ret, Record{Op: RecordAllow, Name: group.Name(), Value: perm})
+		}
+	}
+	for _, endpoint := range s.allEndpointsLocked() {
+		ret = append(ret, Record{Op: RecordEndpoint, Name: endpoint.Name(), Owner: endpoint.Owner().Name()})
+	}
+	now := time.Now()
+	for _, endpoint := range s.allEndpointsLocked() {
+		for _, m := range endpoint.Mail() {
+			if !now.After(m.Expires) {
+				ret = append(ret, mailRecord(endpoint, m))
+			}
+		}
+	}
+	for _, group := range s.Groups() {
+		for _, inner := range group.Groups() {
+			ret = append(ret, Record{Op: RecordJoinGroup, Name: group.Name(), Target: inner.Name()})
+		}
+		for _, endpoint := range group.Endpoints() {
+			ret = append(ret, Record{Op: RecordJoinEndpoint, Name: group.Name(), Target: endpoint.Name()})
+		}
+	}
+	return ret
+}
+
+func (s *State) apply(rec Record) error {
+	switch rec.Op {
+	case RecordUser:
+		_, err := s.NewUser(rec.Name)
+		return err
+	case RecordGroup:
+		owner, err := s.GetUser(rec.Owner)
+		if err != nil {
+			return err
+		}
+		_, err = s.NewGroup(rec.Name, owner)
+		return err
+	case RecordEndpoint:
+		owner, err := s.GetUser(rec.Owner)
+		if err != nil {
+			return err
+		}
+		_, err = s.NewEndpoint(rec.Name, owner)
+		return err
+	case RecordRemoveUser:
+		if user, err := s.GetUser(rec.Name); err == nil {
+			s.RemoveUser(user)
+		}
+	case RecordRemoveGroup:
+		if group, err := s.GetGroup(rec.Name); err == nil {
+			s.RemoveGroup(group)
+		}
+	case RecordRemoveEndpoint:
+		if endpoint, err := s.GetEndpoint(rec.Name); err == nil {
+			s.RemoveEndpoint(endpoint)
+		}
+	case RecordPassword:
+		user, err := s.GetUser(rec.Name)
+		if err != nil {
+			return err
+		}
+		if _, _, _, err := decodePasswordHash(rec.Value); err != nil {
+			return fmt.Errorf("Invalid password hash for %v: %w", rec.Name, err)
+		}
+		user.SetPasswordHash(rec.Value)
+	case RecordToken:
+		user, err := s.GetUser(rec.Name)
+		if err != nil {
+			return err
+		}
+		var t Token
+		if err := json.Unmarshal([]byte(rec.Value), &t); err != nil {
+			return fmt.Errorf("Invalid token for %v: %w", rec.Name, err)
+		}
+		user.AddToken(&t)
+	case RecordTouchToken:
+		if user, err := s.GetUser(rec.Name); err == nil {
+			at, _ := time.Parse(time.RFC3339Nano, rec.Value)
+			user.TouchToken(rec.Target, at)
+		}
+	case RecordRemoveToken:
+		if user, err := s.GetUser(rec.Name); err == nil {
+			user.RemoveToken(rec.Target)
+		}
+	case RecordJoinGroup, RecordLeaveGroup:
+		group, err := s.GetGroup(rec.Name)
+		if err != nil {
+			return err
+		}
+		target, err := s.GetGroup(rec.Target)
+		if err != nil {
+			return err
+		}
+		if rec.Op == RecordJoinGroup {
+			group.AddGroup(target)
+		} else {
+			group.RemoveGroup(target)
+		}
+	case RecordJoinEndpoint, RecordLeaveEndpoint:
+		group, err := s.GetGroup(rec.Name)
+		if err != nil {
+			return err
+		}
+		target, err := s.GetEndpoint(rec.Target)
+		if err != nil {
+			return err
+		}
+		if rec.Op == RecordJoinEndpoint {
+			group.AddEndpoint(target)
+		} else {
+			group.RemoveEndpoint(target)
+		}
+	case RecordAllow, RecordRevoke:
+		group, err := s.GetGroup(rec.Name)
+		if err != nil {
+			return err
+		}
+		if rec.Op == RecordAllow {
+			group.Allow(rec.Value)
+		} else {
+			group.Revoke(rec.Value)
+		}
+	case RecordMail:
+		endpoint, err := s.GetEndpoint(rec.Name)
+		if err != nil {
+			return err
+		}
+		var m Mail
+		if err := json.Unmarshal([]byte(rec.Value), &m); err != nil {
+			return err
+		}
+		endpoint.addMail(m)
+	case RecordRemoveMail:
+		if endpoint, err := s.GetEndpoint(rec.Name); err == nil {
+			endpoint.removeMail(rec.Target)
+		}
+	default:
+		return fmt.Errorf("Unknown record type %v", rec.Op)
+	}
+	return nil
+}
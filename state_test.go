@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drainedEmitter returns an emitter whose queue is consumed until the test
+// ends.
+func drainedEmitter(t *testing.T) *Emitter {
+	e := NewEmitter(DefaultQueueConfig())
+	go e.Run(func(Message) error { return nil })
+	t.Cleanup(e.Close)
+	return e
+}
+
+// TestStateConcurrency hammers the state from many goroutines, run it with
+// -race.
+func TestStateConcurrency(t *testing.T) {
+	defer func(n int) { StoreCompactRecords = n }(StoreCompactRecords)
+	StoreCompactRecords = 16
+
+	dir := t.TempDir()
+	s := openState(t, dir)
+	admin, err := s.NewUser("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := s.NewGroup("shared", admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminbox, err := s.NewEndpoint("adminbox", admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminbox.Connect(drainedEmitter(t))
+
+	const workers = 8
+	const rounds = 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			user, err := s.NewUser(fmt.Sprintf("user%v", w))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			e, err := s.NewEndpoint(fmt.Sprintf("box%v", w), user)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			emitter := drainedEmitter(t)
+			e.Connect(emitter)
+			_, token, err := s.NewToken(user, "ci", time.Hour, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for n := 0; n < rounds; n++ {
+				s.JoinGroup(shared, user.Group())
+				s.PushState(emitter, user)
+				s.UseToken(user, *token)
+				s.LeaveGroup(shared, user.Group())
+			}
+			s.JoinGroup(shared, user.Group())
+		}(w)
+	}
+	for r := 0; r < workers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < rounds; n++ {
+				s.Snapshot()
+				s.PushState(adminbox.Emitter(), admin)
+				s.Broadcast(s.NotifyNewUser("admin"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(s.Snapshot().Users); n != workers+1 {
+		t.Errorf("%v users, expected %v", n, workers+1)
+	}
+	if n := len(shared.Groups()); n != workers {
+		t.Errorf("%v groups joined, expected %v", n, workers)
+	}
+	s.Store().Close()
+
+	reloaded := openState(t, dir)
+	g, err := reloaded.GetGroup("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(g.Groups()); n != workers {
+		t.Errorf("%v groups joined after reload, expected %v", n, workers)
+	}
+}
+
+func TestDisconnectEmitter(t *testing.T) {
+	s := NewState()
+	carol, err := s.NewUser("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := s.NewEndpoint("box", carol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, resumed := NewEmitter(DefaultQueueConfig()), NewEmitter(DefaultQueueConfig())
+	box.Connect(old)
+	box.Disconnect()
+	box.Connect(resumed)
+
+	if box.DisconnectEmitter(old) {
+		t.Error("stale session disconnected the resumed one")
+	}
+	if box.Emitter() != resumed {
+		t.Fatal("resumed session lost the endpoint")
+	}
+	if !box.DisconnectEmitter(resumed) || box.Connected() {
+		t.Error("session could not disconnect itself")
+	}
+}
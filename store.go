@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	StoreSnapshotFile = "snapshot.json"
+	StoreJournalFile  = "journal.log"
+)
+
+// StoreCompactRecords is how many records the journal takes before the state
+// is compacted into a new snapshot, so it never grows without bound.
+var StoreCompactRecords = 4096
+
+const (
+	RecordUser           = "user"
+	RecordGroup          = "group"
+	RecordEndpoint       = "endpoint"
+	RecordRemoveUser     = "remove_user"
+	RecordRemoveGroup    = "remove_group"
+	RecordRemoveEndpoint = "remove_endpoint"
+	RecordPassword       = "password"
+	RecordToken          = "token"
+	RecordTouchToken     = "touch_token"
+	RecordRemoveToken    = "remove_token"
+	RecordJoinGroup      = "join_group"
+	RecordLeaveGroup     = "leave_group"
+	RecordJoinEndpoint   = "join_endpoint"
+	RecordLeaveEndpoint  = "leave_endpoint"
+	RecordAllow          = "allow"
+	RecordRevoke         = "revoke"
+	RecordMail           = "mail"
+	RecordRemoveMail     = "remove_mail"
+)
+
+// A Record describes a single State mutation. The snapshot is a compacted
+// list of records that rebuilds the graph, the journal holds every record
+// appended since.
+type Record struct {
+	Op     string
+	Name   string `json:",omitempty"`
+	Owner  string `json:",omitempty"`
+	Target string `json:",omitempty"`
+	Value  string `json:",omitempty"`
+}
+
+type Store struct {
+	path     string
+	mu       sync.Mutex
+	journal  *os.File
+	appended int
+}
+
+func OpenStore(path string) (*Store, error) {
+	var st Store
+	st.path = path
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	return &st, nil
+}
+
+func (st *Store) Path() string {
+	return st.path
+}
+
+func (st *Store) Load(s *State) error {
+	var snapshot []Record
+	if raw, err := ioutil.ReadFile(filepath.Join(st.path, StoreSnapshotFile)); err == nil {
+		if err := json.Unmarshal(raw, &snapshot); err != nil {
+			return fmt.Errorf("Corrupt snapshot: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, rec := range snapshot {
+		if err := s.apply(rec); err != nil {
+			return fmt.Errorf("Snapshot record %v: %v", rec, err)
+		}
+	}
+
+	journal, err := os.Open(filepath.Join(st.path, StoreJournalFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	// a torn write is expected after a crash, but only as the last line.
+	// Anything past an unreadable line would be lost by the next compaction.
+	var torn error
+	line := 0
+	scanner := bufio.NewScanner(journal)
+	for scanner.Scan() {
+		if torn != nil {
+			return fmt.Errorf("Corrupt journal at line %v: %v", line, torn)
+		}
+		line++
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			torn = err
+			continue
+		}
+		if err := s.apply(rec); err != nil {
+			return fmt.Errorf("Journal record %v: %v", rec, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if torn != nil {
+		log.Printf("Store: [Warning] Dropping torn journal line %v (%v)\n", line, torn)
+	}
+	return nil
+}
+
+func (st *Store) Compact(records []Record) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	raw, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(st.path, StoreSnapshotFile+".tmp")
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(st.path, StoreSnapshotFile)); err != nil {
+		return err
+	}
+
+	if st.journal != nil {
+		st.journal.Close()
+	}
+	st.appended = 0
+	st.journal, err = os.OpenFile(filepath.Join(st.path, StoreJournalFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func (st *Store) Append(rec Record) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.journal == nil {
+		return errors.New("Store journal not open")
+	}
+
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := st.journal.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+	st.appended++
+	return st.journal.Sync()
+}
+
+// NeedsCompaction tells whether the journal has grown past
+// StoreCompactRecords since the last snapshot.
+func (st *Store) NeedsCompaction() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.appended >= StoreCompactRecords
+}
+
+func (st *Store) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.journal == nil {
+		return nil
+	}
+	err := st.journal.Close()
+	st.journal = nil
+	return err
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openState(t *testing.T, dir string) *State {
+	t.Helper()
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewState()
+	if err := s.SetStore(st); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return s
+}
+
+// populate builds a small graph and returns the ID of the token it issued.
+func populate(t *testing.T, s *State) string {
+	t.Helper()
+	bob, err := s.NewUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := s.NewUser("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetPassword(bob, "1234")
+	g, err := s.NewGroup("g", bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.JoinGroup(g, carol.Group())
+	if err := s.AllowGroup(g, PermissionExec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewEndpoint("carolbox", carol); err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := s.NewToken(bob, "ci", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.ID
+}
+
+func checkPopulated(t *testing.T, s *State, token string) {
+	t.Helper()
+	bob, err := s.GetUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bob.CheckPassword("1234") {
+		t.Error("password not restored")
+	}
+	if _, err := bob.GetToken(token); err != nil {
+		t.Errorf("token not restored: %v", err)
+	}
+	g, err := s.GetGroup("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Owner() != bob || !g.Allowed(PermissionExec) {
+		t.Error("group owner or permission not restored")
+	}
+	carol, err := s.GetUser("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := false
+	for _, inner := range g.Groups() {
+		joined = joined || inner == carol.Group()
+	}
+	if !joined {
+		t.Error("group membership not restored")
+	}
+	e, err := s.GetEndpoint("carolbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Owner() != carol {
+		t.Error("endpoint owner not restored")
+	}
+}
+
+func journalLines(t *testing.T, dir string) int {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, StoreJournalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestStoreReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openState(t, dir)
+	token := populate(t, s)
+	if journalLines(t, dir) == 0 {
+		t.Fatal("nothing journaled")
+	}
+	s.Store().Close()
+
+	checkPopulated(t, openState(t, dir), token)
+}
+
+func TestStoreTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openState(t, dir)
+	token := populate(t, s)
+	s.Store().Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, StoreJournalFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Op":"user","Na`)
+	f.Close()
+
+	checkPopulated(t, openState(t, dir), token)
+}
+
+func TestStoreCorruptJournal(t *testing.T) {
+	dir := t.TempDir()
+	s := openState(t, dir)
+	populate(t, s)
+	s.Store().Close()
+
+	path := filepath.Join(dir, StoreJournalFile)
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	corrupt := append([]byte{}, lines[0]...)
+	corrupt = append(corrupt, []byte("garbage\n")...)
+	corrupt = append(corrupt, bytes.Join(lines[1:], nil)...)
+	if err := ioutil.WriteFile(path, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ioutil.ReadFile(filepath.Join(dir, StoreSnapshotFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewState().SetStore(st); err == nil {
+		t.Fatal("corrupt journal loaded")
+	}
+	if after, _ := ioutil.ReadFile(path); !bytes.Equal(after, corrupt) {
+		t.Error("journal was rewritten")
+	}
+	if after, _ := ioutil.ReadFile(filepath.Join(dir, StoreSnapshotFile)); !bytes.Equal(after, snapshot) {
+		t.Error("snapshot was rewritten")
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	defer func(n int) { StoreCompactRecords = n }(StoreCompactRecords)
+	StoreCompactRecords = 5
+
+	dir := t.TempDir()
+	s := openState(t, dir)
+	token := populate(t, s)
+	bob, _ := s.GetUser("bob")
+	t0, _ := bob.GetToken(token)
+	for n := 0; n < 3*StoreCompactRecords; n++ {
+		s.UseToken(bob, t0)
+	}
+	if n := journalLines(t, dir); n >= StoreCompactRecords {
+		t.Errorf("journal holds %v records, compaction expected at %v", n, StoreCompactRecords)
+	}
+	s.Store().Close()
+
+	checkPopulated(t, openState(t, dir), token)
+}
+
+func TestStoreInvalidToken(t *testing.T) {
+	s := NewState()
+	if _, err := s.NewUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.apply(Record{Op: RecordToken, Name: "bob", Value: "0123abcd.secret"}); err == nil {
+		t.Error("unparseable token record loaded")
+	}
+	bob, _ := s.GetUser("bob")
+	if len(bob.Tokens()) != 0 {
+		t.Error("unparseable token record added a token")
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Streams are ordered byte streams between two endpoints, multiplexed over
+// the broker connection next to regular messages. Each side may have
+// StreamWindow bytes in flight before the reader acknowledges them, so a slow
+// reader stalls its own stream but never the connection it shares.
+const (
+	StreamWindow    = 256 * 1024
+	StreamChunkSize = 16 * 1024
+)
+
+// Kinds of streams, an endpoint only accepts those it has a handler for.
+const (
+	StreamTunnel = "tunnel"
+	StreamShell  = "shell"
+)
+
+// StreamPermissions maps each kind of stream to the permission the broker
+// requires for opening one.
+var StreamPermissions = map[string]string{
+	StreamTunnel: PermissionTunnel,
+	StreamShell:  PermissionShell,
+}
+
+var ErrStreamReset = errors.New("Stream closed by peer")
+
+type StreamAddr struct {
+	Endpoint string
+	Stream   string
+}
+
+func (a StreamAddr) Network() string {
+	return "tarragon"
+}
+
+func (a StreamAddr) String() string {
+	return a.Endpoint + "/" + a.Stream
+}
+
+// A Stream is a net.Conn to another endpoint.
+type Stream struct {
+	instance *Instance
+	id       string
+	kind     string
+	local    StreamAddr
+	remote   StreamAddr
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	queue         [][]byte
+	queued        int
+	unacked       int
+	credit        int
+	eof           bool  // the peer sends no more
+	shut          bool  // we send no more
+	closed        bool  // closed on this side
+	readErr       error // the stream ended before the peer finished sending
+	reset         error // torn down by the peer or with the session
+	readDeadline  time.Time
+	writeDeadline time.Time
+	onControl     func(data map[string]string)
+	controls      []map[string]string
+}
+
+// A StreamRequest is a stream another endpoint wants to open. Handlers must
+// either Accept or Reject it.
+type StreamRequest struct {
+	From   string
+	Kind   string
+	Params map[string]string
+
+	instance *Instance
+	msg      Message
+}
+
+func newStream(i *Instance, id string, kind string, local StreamAddr, remote StreamAddr) *Stream {
+	var s Stream
+
+	s.instance = i
+	s.id = id
+	s.kind = kind
+	s.local = local
+	s.remote = remote
+	s.cond = sync.NewCond(&s.mu)
+	s.credit = StreamWindow
+
+	return &s
+}
+
+func isStreamMessage(typ int) bool {
+	switch typ {
+	case MessageStreamOpen, MessageStreamData, MessageStreamWindow, MessageStreamClose, MessageStreamControl:
+		return true
+	}
+	return false
+}
+
+// HandleStream registers handler for streams of kind opened by other
+// endpoints. It runs in its own goroutine per request.
+func (i *Instance) HandleStream(kind string, handler func(req *StreamRequest)) *Instance {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.streamHandlers[kind] = handler
+	return i
+}
+
+// OpenStream opens a stream of kind to the endpoint to, which gets params
+// along with the request.
+func (i *Instance) OpenStream(ctx context.Context, to string, kind string, params map[string]string) (*Stream, error) {
+	i.mu.Lock()
+	i.nextStream++
+	id := strconv.FormatUint(i.nextStream, 10)
+	// registered up front, the peer may start sending before our reply
+	s := newStream(i, id, kind, StreamAddr{i.hostname, id}, StreamAddr{to, id})
+	i.conns[id] = s
+	i.mu.Unlock()
+
+	msg := NewMessage(MessageStreamOpen)
+	msg.Encode(StreamOpenPayload{To: to, Kind: kind, Stream: id, Params: params})
+
+	msg, err := i.Execute(ctx, msg)
+	if err == nil && !msg.Success {
+		err = msg.Err()
+	}
+	if err != nil {
+		i.removeStream(id)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (i *Instance) acceptStream(msg Message, open *StreamOpenPayload) {
+	msg.Reply = true
+	req := StreamRequest{From: open.From, Kind: open.Kind, Params: open.Params, instance: i, msg: msg}
+
+	i.mu.RLock()
+	handler := i.streamHandlers[req.Kind]
+	i.mu.RUnlock()
+	if handler == nil {
+		req.Reject(errors.New("Unknown stream kind: " + req.Kind))
+		return
+	}
+	handler(&req)
+}
+
+func (r *StreamRequest) Accept() *Stream {
+	i := r.instance
+	id := r.msg.Data["stream"]
+	s := newStream(i, id, r.Kind, StreamAddr{i.hostname, id}, StreamAddr{r.From, id})
+	i.mu.Lock()
+	i.conns[id] = s
+	i.mu.Unlock()
+
+	r.msg.Success = true
+	r.reply()
+	return s
+}
+
+func (r *StreamRequest) Reject(err error) {
+	r.msg.Fail(err)
+	r.reply()
+}
+
+func (r *StreamRequest) reply() {
+	ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+	defer cancel()
+	if err := r.instance.Send(ctx, r.msg); err != nil {
+		log.Printf("Instance: [Warning] Failed to answer stream request (%v)\n", err)
+	}
+}
+
+// receiveStream is called from the receive loop and must not block.
+func (i *Instance) receiveStream(msg Message, payload interface{}) {
+	if msg.Type == MessageStreamOpen {
+		go i.acceptStream(msg, payload.(*StreamOpenPayload))
+		return
+	}
+
+	i.mu.RLock()
+	s := i.conns[msg.Data["stream"]]
+	i.mu.RUnlock()
+	if s == nil {
+		return
+	}
+
+	switch req := payload.(type) {
+	case *StreamDataPayload:
+		if !s.push(req.Data) {
+			log.Printf("Instance: Closing misbehaving stream %v\n", s.id)
+			s.Close()
+		}
+	case *StreamWindowPayload:
+		s.mu.Lock()
+		s.credit += req.Bytes
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	case *StreamControlPayload:
+		s.mu.Lock()
+		handler := s.onControl
+		if handler == nil {
+			s.controls = append(s.controls, req.Data)
+		}
+		s.mu.Unlock()
+		if handler != nil {
+			handler(req.Data)
+		}
+	case *StreamClosePayload:
+		s.mu.Lock()
+		if !req.Half {
+			s.end(ErrStreamReset)
+		}
+		s.eof = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if !req.Half {
+			i.removeStream(s.id)
+		}
+	}
+}
+
+func (i *Instance) removeStream(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.conns, id)
+}
+
+// dropStreams resets every stream, they do not survive the session.
+func (i *Instance) dropStreams() {
+	i.mu.Lock()
+	conns := i.conns
+	i.conns = make(map[string]*Stream)
+	i.mu.Unlock()
+
+	for _, s := range conns {
+		s.mu.Lock()
+		s.end(ErrConnectionLost)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// end must be called with mu held.
+func (s *Stream) end(err error) {
+	if !s.eof {
+		s.readErr = err
+		s.eof = true
+	}
+	s.reset = err
+}
+
+// push queues data from the peer, refusing more than it was granted.
+func (s *Stream) push(chunk []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.eof {
+		return true
+	}
+	if s.queued+len(chunk) > StreamWindow {
+		return false
+	}
+	s.queue = append(s.queue, chunk)
+	s.queued += len(chunk)
+	s.cond.Broadcast()
+	return true
+}
+
+// Control sends data out of band, i.e. to resize a terminal, to the peer's
+// OnControl handler.
+func (s *Stream) Control(data map[string]string) error {
+	msg := NewMessage(MessageStreamControl)
+	msg.Encode(StreamControlPayload{s.id, data})
+	return s.send(msg)
+}
+
+// OnControl sets the handler for control messages, replaying those received
+// before it was set. It is called from the receive loop and must not block.
+func (s *Stream) OnControl(handler func(data map[string]string)) *Stream {
+	s.mu.Lock()
+	s.onControl = handler
+	pending := s.controls
+	s.controls = nil
+	s.mu.Unlock()
+
+	for _, data := range pending {
+		handler(data)
+	}
+	return s
+}
+
+func (s *Stream) Kind() string {
+	return s.kind
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.closed || len(s.queue) == 0 {
+		var err error
+		switch {
+		case s.closed:
+			err = net.ErrClosed
+		case s.readErr != nil:
+			err = s.readErr
+		case s.eof:
+			err = io.EOF
+		case expired(s.readDeadline):
+			err = os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+		s.cond.Wait()
+	}
+
+	n := copy(p, s.queue[0])
+	if n == len(s.queue[0]) {
+		s.queue = s.queue[1:]
+	} else {
+		s.queue[0] = s.queue[0][n:]
+	}
+	s.queued -= n
+	s.unacked += n
+	ack := 0
+	// acknowledging in batches, the sender still has credit meanwhile
+	if s.unacked >= StreamWindow/4 {
+		ack, s.unacked = s.unacked, 0
+	}
+	s.mu.Unlock()
+
+	if ack > 0 {
+		msg := NewMessage(MessageStreamWindow)
+		msg.Encode(StreamWindowPayload{s.id, ack})
+		s.send(msg)
+	}
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		for s.credit == 0 && s.writeErr() == nil && !expired(s.writeDeadline) {
+			s.cond.Wait()
+		}
+		if err := s.writeErr(); err != nil {
+			s.mu.Unlock()
+			return written, err
+		}
+		if expired(s.writeDeadline) {
+			s.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		n := len(p) - written
+		if n > s.credit {
+			n = s.credit
+		}
+		if n > StreamChunkSize {
+			n = StreamChunkSize
+		}
+		s.credit -= n
+		s.mu.Unlock()
+
+		msg := NewMessage(MessageStreamData)
+		msg.Encode(StreamDataPayload{s.id, p[written : written+n]})
+		if err := s.send(msg); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// writeErr must be called with mu held.
+func (s *Stream) writeErr() error {
+	switch {
+	case s.closed:
+		return net.ErrClosed
+	case s.reset != nil:
+		return s.reset
+	case s.shut:
+		return errors.New("Stream closed for writing")
+	}
+	return nil
+}
+
+// CloseWrite tells the peer no more data follows, it may keep sending.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.shut || s.closed || s.reset != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.shut = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	msg := NewMessage(MessageStreamClose)
+	msg.Encode(StreamClosePayload{s.id, true})
+	return s.send(msg)
+}
+
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	reset := s.reset != nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.instance.removeStream(s.id)
+	if reset {
+		return nil
+	}
+	msg := NewMessage(MessageStreamClose)
+	msg.Encode(StreamClosePayload{Stream: s.id})
+	return s.send(msg)
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.local
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	s.wakeAt(t)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = t
+	s.wakeAt(t)
+	return nil
+}
+
+// wakeAt makes waiters recheck their deadline once t has passed.
+func (s *Stream) wakeAt(t time.Time) {
+	s.cond.Broadcast()
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (s *Stream) send(msg Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+	defer cancel()
+	return s.instance.Send(ctx, msg)
+}
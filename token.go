@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+type Token struct {
+	ID       string
+	Label    string
+	Hash     string `json:",omitempty"`
+	Created  time.Time
+	LastUsed time.Time
+	Expires  time.Time
+	Endpoint string
+}
+
+// Tokens are handed out as "<id>.<secret>", only the hash of the whole string
+// is kept so a leaked store does not leak usable credentials.
+func NewToken(label string, ttl time.Duration, endpoint string) (string, *Token, error) {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	var t Token
+	t.ID = hex.EncodeToString(id)
+	t.Label = label
+	t.Endpoint = endpoint
+	t.Created = time.Now().UTC()
+	if ttl > 0 {
+		t.Expires = t.Created.Add(ttl)
+	}
+
+	token := t.ID + "." + base64.RawURLEncoding.EncodeToString(secret)
+	t.Hash = hashToken(token)
+
+	return token, &t, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func tokenID(token string) string {
+	return strings.SplitN(token, ".", 2)[0]
+}
+
+func (t Token) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+// Public returns a copy that is safe to hand to clients.
+func (t Token) Public() Token {
+	ret := t
+	ret.Hash = ""
+	return ret
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Topics are dot separated, i.e. "build.linux.done". Patterns may use '*' for
+// exactly one segment and a trailing '#' for any number of remaining ones.
+const (
+	TopicSeparator = "."
+	TopicWildcard  = "*"
+	TopicRest      = "#"
+)
+
+// A Subscription lives as long as the session that made it. Scoped to a group
+// it only receives publications from endpoints in that group, otherwise from
+// any endpoint that can reach the subscriber.
+type Subscription struct {
+	Endpoint *Endpoint
+	Pattern  string
+	Group    string
+}
+
+type SubscriptionSnapshot struct {
+	Endpoint string
+	Pattern  string
+	Group    string
+}
+
+type Topics struct {
+	mu   sync.RWMutex
+	subs map[*Emitter]map[Subscription]struct{}
+}
+
+func NewTopics() *Topics {
+	var t Topics
+
+	t.subs = make(map[*Emitter]map[Subscription]struct{})
+
+	return &t
+}
+
+func validTopic(topic string, pattern bool) error {
+	segments := strings.Split(topic, TopicSeparator)
+	for n, segment := range segments {
+		switch {
+		case len(segment) == 0:
+			return &ProtocolError{CodeInvalid, "Invalid topic, empty segment"}
+		case !pattern && (segment == TopicWildcard || segment == TopicRest):
+			return &ProtocolError{CodeInvalid, "Invalid topic, wildcards are only allowed in subscriptions"}
+		case segment == TopicRest && n != len(segments)-1:
+			return &ProtocolError{CodeInvalid, "Invalid topic, '" + TopicRest + "' must be the last segment"}
+		case len(segment) > 1 && strings.ContainsAny(segment, TopicWildcard+TopicRest):
+			return &ProtocolError{CodeInvalid, "Invalid topic, wildcards must span a whole segment"}
+		}
+	}
+	return nil
+}
+
+func topicMatch(pattern string, topic string) bool {
+	want := strings.Split(pattern, TopicSeparator)
+	have := strings.Split(topic, TopicSeparator)
+	for n, segment := range want {
+		if segment == TopicRest {
+			return true
+		}
+		if n >= len(have) || (segment != TopicWildcard && segment != have[n]) {
+			return false
+		}
+	}
+	return len(want) == len(have)
+}
+
+func (t *Topics) Subscribe(e *Emitter, sub Subscription) error {
+	if err := validTopic(sub.Pattern, true); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subs[e] == nil {
+		t.subs[e] = make(map[Subscription]struct{})
+	}
+	t.subs[e][sub] = struct{}{}
+	return nil
+}
+
+func (t *Topics) Unsubscribe(e *Emitter, sub Subscription) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.subs[e][sub]; !ok {
+		return false
+	}
+	delete(t.subs[e], sub)
+	if len(t.subs[e]) == 0 {
+		delete(t.subs, e)
+	}
+	return true
+}
+
+// Drop removes every subscription of a session, returning how many it held.
+func (t *Topics) Drop(e *Emitter) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.subs[e])
+	delete(t.subs, e)
+	return n
+}
+
+// Match returns the subscriptions matching topic, grouped by session.
+func (t *Topics) Match(topic string) map[*Emitter][]Subscription {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ret := make(map[*Emitter][]Subscription)
+	for e, subs := range t.subs {
+		for sub := range subs {
+			if topicMatch(sub.Pattern, topic) {
+				ret[e] = append(ret[e], sub)
+			}
+		}
+	}
+	return ret
+}
+
+func (t *Topics) Snapshot() []SubscriptionSnapshot {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var ret []SubscriptionSnapshot
+	for _, subs := range t.subs {
+		for sub := range subs {
+			ret = append(ret, SubscriptionSnapshot{Endpoint: sub.Endpoint.Name(), Pattern: sub.Pattern, Group: sub.Group})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Endpoint != ret[j].Endpoint {
+			return ret[i].Endpoint < ret[j].Endpoint
+		}
+		return ret[i].Pattern < ret[j].Pattern
+	})
+	return ret
+}
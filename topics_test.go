@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestTopicMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"build.linux.done", "build.linux.done", true},
+		{"build.linux.done", "build.linux", false},
+		{"build.linux", "build.linux.done", false},
+		{"build.*.done", "build.linux.done", true},
+		{"build.*.done", "build.linux.arm.done", false},
+		{"build.*", "build", false},
+		{"*", "build", true},
+		{"*", "build.linux", false},
+		{"build.#", "build.linux.arm.done", true},
+		{"build.#", "build", true},
+		{"build.#", "deploy.linux", false},
+		{"#", "build.linux", true},
+		{"*.*.#", "build.linux", true},
+		{"*.*.#", "build", false},
+	} {
+		if match := topicMatch(c.pattern, c.topic); match != c.match {
+			t.Errorf("topicMatch(%q, %q) = %v, expected %v", c.pattern, c.topic, match, c.match)
+		}
+	}
+}
+
+func TestValidTopic(t *testing.T) {
+	for _, c := range []struct {
+		topic   string
+		pattern bool
+		valid   bool
+	}{
+		{"build.linux", false, true},
+		{"build.*", false, false},
+		{"build.#", false, false},
+		{"build.*", true, true},
+		{"build.#", true, true},
+		{"#.build", true, false},
+		{"build.lin*", true, false},
+		{"build..linux", true, false},
+		{"", true, false},
+	} {
+		if err := validTopic(c.topic, c.pattern); (err == nil) != c.valid {
+			t.Errorf("validTopic(%q, %v) = %v, expected valid %v", c.topic, c.pattern, err, c.valid)
+		}
+	}
+}
+
+func TestTopicsMatch(t *testing.T) {
+	topics := NewTopics()
+	a, b := NewEmitter(DefaultQueueConfig()), NewEmitter(DefaultQueueConfig())
+	for _, sub := range []struct {
+		e       *Emitter
+		pattern string
+	}{{a, "build.*"}, {a, "build.#"}, {b, "deploy.#"}} {
+		if err := topics.Subscribe(sub.e, Subscription{Pattern: sub.pattern}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matched := topics.Match("build.linux")
+	if len(matched) != 1 || len(matched[a]) != 2 {
+		t.Errorf("unexpected match: %v", matched)
+	}
+	if topics.Drop(a) != 2 || len(topics.Match("build.linux")) != 0 {
+		t.Error("subscriptions survived their session")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A tunnel carries one TCP connection between two endpoints over a Stream.
+var TunnelDialTimeout = 5 * time.Second
+
+// A Forward is a local listener whose connections are tunnelled to Addr on
+// endpoint To.
+type Forward struct {
+	Local string
+	To    string
+	Addr  string
+
+	listener net.Listener
+}
+
+// tunnelAddr completes a bare port to the loopback address.
+func tunnelAddr(addr string) (string, error) {
+	if !strings.Contains(addr, ":") {
+		addr = "127.0.0.1:" + addr
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// Expose lets other endpoints open tunnels to addr, given the
+// PermissionTunnel. A bare port means that port on the loopback address.
+func (i *Instance) Expose(addr string) error {
+	addr, err := tunnelAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.exposed[addr] = struct{}{}
+	return nil
+}
+
+func (i *Instance) Unexpose(addr string) *Instance {
+	if full, err := tunnelAddr(addr); err == nil {
+		addr = full
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.exposed, addr)
+	return i
+}
+
+func (i *Instance) Exposed() []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var ret []string
+	for addr := range i.exposed {
+		ret = append(ret, addr)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Forward listens on local and tunnels every accepted connection to addr on
+// the endpoint to, until Unforward is called.
+func (i *Instance) Forward(local string, to string, addr string) error {
+	addr, err := tunnelAddr(addr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", local)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	if _, ok := i.forwards[local]; ok {
+		i.mu.Unlock()
+		listener.Close()
+		return errors.New("Already forwarding " + local)
+	}
+	i.forwards[local] = &Forward{Local: local, To: to, Addr: addr, listener: listener}
+	i.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go i.openTunnel(conn, to, addr)
+		}
+	}()
+	return nil
+}
+
+// Unforward stops accepting on local, tunnels already open stay up.
+func (i *Instance) Unforward(local string) error {
+	i.mu.Lock()
+	forward, ok := i.forwards[local]
+	delete(i.forwards, local)
+	i.mu.Unlock()
+
+	if !ok {
+		return errors.New("Not forwarding " + local)
+	}
+	return forward.listener.Close()
+}
+
+func (i *Instance) Forwards() []Forward {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var ret []Forward
+	for _, forward := range i.forwards {
+		ret = append(ret, *forward)
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].Local < ret[b].Local
+	})
+	return ret
+}
+
+func (i *Instance) openTunnel(conn net.Conn, to string, addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*DeliveryTimeout)
+	defer cancel()
+	s, err := i.OpenStream(ctx, to, StreamTunnel, map[string]string{"addr": addr})
+	if err != nil {
+		log.Printf("Instance: Failed to open tunnel to %v on %v (%v)\n", addr, to, err)
+		conn.Close()
+		return
+	}
+
+	log.Printf("Instance: Tunnel %v to %v on %v opened\n", conn.RemoteAddr(), addr, to)
+	splice(conn, s)
+}
+
+// acceptTunnel serves a tunnel opened by another endpoint.
+func (i *Instance) acceptTunnel(req *StreamRequest) {
+	addr := req.Params["addr"]
+	i.mu.RLock()
+	_, ok := i.exposed[addr]
+	i.mu.RUnlock()
+	if !ok {
+		log.Printf("Instance: Refusing tunnel to %v for %v\n", addr, req.From)
+		req.Reject(&ProtocolError{CodeRefused, "Address not exposed: " + addr})
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, TunnelDialTimeout)
+	if err != nil {
+		req.Reject(err)
+		return
+	}
+
+	s := req.Accept()
+	log.Printf("Instance: Tunnel from %v to %v opened\n", req.From, addr)
+	splice(conn, s)
+}
+
+// splice copies between conn and s until both directions are done, passing
+// on half-closes. An error in either direction tears down both.
+func splice(conn net.Conn, s *Stream) {
+	done := make(chan struct{})
+	go func() {
+		if _, err := io.Copy(conn, s); err != nil {
+			conn.Close()
+		} else if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			conn.Close()
+		}
+		close(done)
+	}()
+
+	if _, err := io.Copy(s, conn); err != nil {
+		s.Close()
+	} else {
+		s.CloseWrite()
+	}
+	<-done
+	conn.Close()
+	s.Close()
+}
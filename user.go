@@ -1,9 +1,10 @@
 package main
 
 import (
-	"math/rand"
+	"log"
+	"sort"
+	"sync"
 	"time"
-	"unsafe"
 )
 
 type User struct {
@@ -11,8 +12,9 @@ type User struct {
 
 	group *Group
 
+	mu       sync.RWMutex
 	password string
-	tokens   map[string]struct{}
+	tokens   map[string]*Token
 }
 
 func NewUser(name string) *User {
@@ -21,7 +23,7 @@ func NewUser(name string) *User {
 	u.SetOwner(&u)
 
 	u.group = NewGroup(name)
-	u.tokens = make(map[string]struct{})
+	u.tokens = make(map[string]*Token)
 
 	return &u
 }
@@ -35,54 +37,106 @@ func (u *User) Endpoints() []*Endpoint {
 }
 
 func (u *User) SetPassword(pass string) *User {
-	// TODO: turn to hash
-	u.password = pass
+	if hash, err := hashPassword(pass, PasswordParamsCurrent()); err == nil {
+		u.SetPasswordHash(hash)
+	} else {
+		log.Printf("User: [Warning] Failed to hash password for %v (%v)\n", u.Name(), err)
+	}
 	return u
 }
 
-func (u *User) CheckPassword(pass string) bool {
-	return u.password == pass
+func (u *User) PasswordHash() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.password
 }
 
-func (u *User) NewToken() string {
-	token := randString(32)
-	u.tokens[token] = struct{}{}
-	return token
+func (u *User) SetPasswordHash(hash string) *User {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.password = hash
+	return u
 }
 
-func (u *User) CheckToken(token string) bool {
-	_, ok := u.tokens[token]
-	return ok
+func (u *User) CheckPassword(pass string) bool {
+	hash := u.PasswordHash()
+	if len(hash) == 0 {
+		return false
+	}
+	return verifyPassword(pass, hash)
 }
 
-func (u *User) RemoveToken(token string) {
-	delete(u.tokens, token)
+func (u *User) PasswordNeedsRehash() bool {
+	return passwordNeedsRehash(u.PasswordHash(), PasswordParamsCurrent())
 }
 
-// https://stackoverflow.com/a/31832326
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-const (
-	letterIdxBits = 6                    // 6 bits to represent a letter index
-	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
-)
+func (u *User) NewToken(label string, ttl time.Duration, endpoint string) (string, *Token, error) {
+	token, t, err := NewToken(label, ttl, endpoint)
+	if err != nil {
+		return "", nil, err
+	}
+	u.AddToken(t)
+	return token, t, nil
+}
 
-func randString(n int) string {
-	src := rand.NewSource(time.Now().UnixNano())
+func (u *User) AddToken(t *Token) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.tokens[t.Hash] = t
+}
 
-	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+func (u *User) CheckToken(token string) (Token, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	t, ok := u.tokens[hashToken(token)]
+	if !ok || t.Expired() {
+		return Token{}, false
+	}
+	return *t, true
+}
+
+func (u *User) TouchToken(id string, at time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, t := range u.tokens {
+		if t.ID == id {
+			t.LastUsed = at
+			return nil
 		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
+	}
+	return &ProtocolError{CodeNotFound, "Token not found"}
+}
+
+func (u *User) GetToken(id string) (Token, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, t := range u.tokens {
+		if t.ID == id {
+			return *t, nil
 		}
-		cache >>= letterIdxBits
-		remain--
 	}
+	return Token{}, &ProtocolError{CodeNotFound, "Token not found"}
+}
+
+func (u *User) Tokens() []Token {
+	u.mu.RLock()
+	var ret []Token
+	for _, t := range u.tokens {
+		ret = append(ret, *t)
+	}
+	u.mu.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.Before(ret[j].Created)
+	})
+	return ret
+}
 
-	return *(*string)(unsafe.Pointer(&b))
+func (u *User) RemoveToken(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for hash, t := range u.tokens {
+		if t.ID == id {
+			delete(u.tokens, hash)
+		}
+	}
 }
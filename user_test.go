@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// fastPasswords makes hashing cheap for the duration of a test.
+func fastPasswords(t *testing.T) PasswordParams {
+	t.Helper()
+	old := PasswordParamsCurrent()
+	params := PasswordParams{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+	if err := SetPasswordParams(params); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetPasswordParams(old) })
+	return params
+}
+
+func TestPlaintextPasswordRejected(t *testing.T) {
+	fastPasswords(t)
+	s := NewState()
+	bob, err := s.NewUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.SetPasswordHash("1234")
+	if s.Authenticate(bob, "1234") {
+		t.Error("plaintext password accepted")
+	}
+	if bob.PasswordHash() != "1234" {
+		t.Error("rehashed on a failed login")
+	}
+
+	if err := s.apply(Record{Op: RecordPassword, Name: "bob", Value: "1234"}); err == nil {
+		t.Error("plaintext password record loaded")
+	}
+}
+
+func TestAuthenticateRehashesOutdatedParams(t *testing.T) {
+	params := fastPasswords(t)
+	dir := t.TempDir()
+	s := openState(t, dir)
+	bob, err := s.NewUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetPassword(bob, "1234")
+	old := bob.PasswordHash()
+	if s.Authenticate(bob, "wrong") {
+		t.Fatal("wrong password accepted")
+	}
+
+	params.Time = 2
+	if err := SetPasswordParams(params); err != nil {
+		t.Fatal(err)
+	}
+	if !bob.PasswordNeedsRehash() {
+		t.Fatal("outdated parameters not detected")
+	}
+	if !s.Authenticate(bob, "1234") {
+		t.Fatal("password rejected after parameter change")
+	}
+	if bob.PasswordHash() == old || !strings.Contains(bob.PasswordHash(), ",t=2,") {
+		t.Errorf("password not rehashed with current parameters: %v", bob.PasswordHash())
+	}
+	if !s.Authenticate(bob, "1234") {
+		t.Error("rehashed password rejected")
+	}
+
+	s.Store().Close()
+	reloaded, err := openState(t, dir).GetUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.PasswordHash() != bob.PasswordHash() {
+		t.Error("rehashed password not journaled")
+	}
+}
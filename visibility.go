@@ -0,0 +1,298 @@
+package main
+
+import (
+	"sort"
+)
+
+// A Visibility is the part of the graph a single user may see. That is their
+// own endpoints, every group they own or are a transitive member of, and the
+// members of those groups along with their endpoints. Sessions are only ever
+// told about what is in it.
+type Visibility struct {
+	users     map[string]struct{}
+	groups    map[string]string // name -> owner
+	endpoints map[string]string // name -> owner
+	online    map[string]struct{}
+	members   map[string]map[string]struct{}
+	contents  map[string]map[string]struct{}
+}
+
+func newVisibility() *Visibility {
+	var v Visibility
+
+	v.users = make(map[string]struct{})
+	v.groups = make(map[string]string)
+	v.endpoints = make(map[string]string)
+	v.online = make(map[string]struct{})
+	v.members = make(map[string]map[string]struct{})
+	v.contents = make(map[string]map[string]struct{})
+
+	return &v
+}
+
+func (v *Visibility) User(name string) bool {
+	_, ok := v.users[name]
+	return ok
+}
+
+func (v *Visibility) Group(name string) bool {
+	_, ok := v.groups[name]
+	return ok
+}
+
+func (v *Visibility) Endpoint(name string) bool {
+	_, ok := v.endpoints[name]
+	return ok
+}
+
+// Allows reports whether every entity msg refers to is visible.
+func (v *Visibility) Allows(msg Message) bool {
+	switch msg.Type {
+	case MessageEventNewUser, MessageEventRemoveUser:
+		return v.User(msg.Data["name"])
+	case MessageEventNewGroup, MessageEventRemoveGroup:
+		return v.Group(msg.Data["name"])
+	case MessageEventNewEndpoint, MessageEventRemoveEndpoint, MessageEventEndpointOnline, MessageEventEndpointOffline:
+		return v.Endpoint(msg.Data["name"])
+	case MessageEventGroupGroupJoin, MessageEventGroupGroupLeave:
+		return v.Group(msg.Data["group"]) && (v.Group(msg.Data["target"]) || v.User(msg.Data["target"]))
+	case MessageEventGroupEndpointJoin, MessageEventGroupEndpointLeave:
+		return v.Group(msg.Data["group"]) && v.Endpoint(msg.Data["endpoint"])
+	}
+	return true
+}
+
+func (v *Visibility) addEndpoint(e *Endpoint) {
+	v.endpoints[e.Name()] = e.Owner().Name()
+	if e.Online() {
+		v.online[e.Name()] = struct{}{}
+	}
+	v.users[e.Owner().Name()] = struct{}{}
+}
+
+func (v *Visibility) addGroup(g *Group) {
+	v.groups[g.Name()] = g.Owner().Name()
+	v.users[g.Owner().Name()] = struct{}{}
+}
+
+// viewEvents returns the messages that turn a session's view from before
+// into v, additions ordered so entities exist before they are linked,
+// removals so links are dropped before their entities.
+func (s *State) viewEvents(before *Visibility, v *Visibility) []Message {
+	var ret []Message
+
+	for _, name := range sortedSet(v.users) {
+		if !before.User(name) {
+			ret = append(ret, s.NotifyNewUser(name))
+		}
+	}
+	for _, name := range sortedOwned(v.endpoints) {
+		if !before.Endpoint(name) {
+			ret = append(ret, s.NotifyNewEndpoint(name, v.endpoints[name]))
+			if _, ok := v.online[name]; ok {
+				msg := NewMessage(MessageEventEndpointOnline)
+				msg.Encode(EventPayload{Name: name})
+				ret = append(ret, msg)
+			}
+		}
+	}
+	for _, name := range sortedOwned(v.groups) {
+		if !before.Group(name) {
+			ret = append(ret, s.NotifyNewGroup(name, v.groups[name]))
+		}
+	}
+	for _, group := range sortedLinks(v.members) {
+		for _, target := range sortedSet(v.members[group]) {
+			if _, ok := before.members[group][target]; !ok {
+				ret = append(ret, s.NotifyGroupGroupJoin(group, target))
+			}
+		}
+	}
+	for _, group := range sortedLinks(v.contents) {
+		for _, endpoint := range sortedSet(v.contents[group]) {
+			if _, ok := before.contents[group][endpoint]; !ok {
+				ret = append(ret, s.NotifyGroupEndpointJoin(group, endpoint))
+			}
+		}
+	}
+
+	for _, group := range sortedLinks(before.members) {
+		for _, target := range sortedSet(before.members[group]) {
+			if _, ok := v.members[group][target]; !ok {
+				ret = append(ret, s.NotifyGroupGroupLeave(group, target))
+			}
+		}
+	}
+	for _, group := range sortedLinks(before.contents) {
+		for _, endpoint := range sortedSet(before.contents[group]) {
+			if _, ok := v.contents[group][endpoint]; !ok {
+				ret = append(ret, s.NotifyGroupEndpointLeave(group, endpoint))
+			}
+		}
+	}
+	for _, name := range sortedOwned(before.endpoints) {
+		if !v.Endpoint(name) {
+			ret = append(ret, s.NotifyRemoveEndpoint(name))
+		}
+	}
+	for _, name := range sortedOwned(before.groups) {
+		if !v.Group(name) {
+			ret = append(ret, s.NotifyRemoveGroup(name))
+		}
+	}
+	for _, name := range sortedSet(before.users) {
+		if !v.User(name) {
+			ret = append(ret, s.NotifyRemoveUser(name))
+		}
+	}
+
+	return ret
+}
+
+func sortedSet(m map[string]struct{}) []string {
+	var ret []string
+	for key := range m {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sortedLinks(m map[string]map[string]struct{}) []string {
+	var ret []string
+	for key := range m {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sortedOwned(m map[string]string) []string {
+	var ret []string
+	for key := range m {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// visibilityLocked must be called with mu held.
+func (s *State) visibilityLocked(user *User) *Visibility {
+	v := newVisibility()
+	v.users[user.Name()] = struct{}{}
+	for _, endpoint := range user.Endpoints() {
+		v.addEndpoint(endpoint)
+	}
+
+	for _, group := range s.pureGroupsLocked() {
+		if group.Owner() != user && !s.memberLocked(group, user.Group(), make(map[*Group]struct{})) {
+			continue
+		}
+		v.addGroup(group)
+		members := make(map[string]struct{})
+		for _, inner := range group.Groups() {
+			members[inner.Name()] = struct{}{}
+			if u := s.groupUserLocked(inner); u != nil {
+				v.users[u.Name()] = struct{}{}
+			} else {
+				v.addGroup(inner)
+			}
+		}
+		v.members[group.Name()] = members
+		contents := make(map[string]struct{})
+		for _, endpoint := range group.Endpoints() {
+			contents[endpoint.Name()] = struct{}{}
+		}
+		v.contents[group.Name()] = contents
+		// members see each other's endpoints, as group sends reach them
+		all := make(map[*Endpoint]struct{})
+		s.expandGroupLocked(group, all, make(map[*Group]struct{}))
+		for endpoint := range all {
+			v.addEndpoint(endpoint)
+		}
+	}
+
+	return v
+}
+
+// memberLocked reports whether target is in group, directly or through
+// nested pure groups. User groups are not descended into, they only hold
+// what a user owns.
+func (s *State) memberLocked(group *Group, target *Group, seen map[*Group]struct{}) bool {
+	if _, ok := seen[group]; ok {
+		return false
+	}
+	seen[group] = struct{}{}
+	for _, inner := range group.Groups() {
+		if inner == target {
+			return true
+		}
+		if s.groupUserLocked(inner) == nil && s.memberLocked(inner, target, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) groupUserLocked(group *Group) *User {
+	for user := range s.users {
+		if user.Group() == group {
+			return user
+		}
+	}
+	return nil
+}
+
+// CanReach reports whether from may message to: both have the same owner or
+// share a group, i.e. either endpoint is visible to the other's owner so
+// replies always make it back.
+func (s *State) CanReach(from *Endpoint, to *Endpoint) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.visibilityLocked(from.Owner()).Endpoint(to.Name()) || s.visibilityLocked(to.Owner()).Endpoint(from.Name())
+}
+
+func (s *State) Visibility(user *User) *Visibility {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.visibilityLocked(user)
+}
+
+// viewsLocked returns the current view of every connected endpoint.
+func (s *State) viewsLocked() map[*Emitter]*Visibility {
+	ret := make(map[*Emitter]*Visibility)
+	byUser := make(map[*User]*Visibility)
+	for _, endpoint := range s.allEndpointsLocked() {
+		emitter := endpoint.Emitter()
+		if emitter == nil {
+			continue
+		}
+		v, ok := byUser[endpoint.Owner()]
+		if !ok {
+			v = s.visibilityLocked(endpoint.Owner())
+			byUser[endpoint.Owner()] = v
+		}
+		ret[emitter] = v
+	}
+	return ret
+}
+
+// mutate runs fn with mu held, then brings every connected session's view
+// up to date once the lock is released.
+func (s *State) mutate(fn func()) {
+	s.mu.Lock()
+	before := s.viewsLocked()
+	fn()
+	after := s.viewsLocked()
+	s.mu.Unlock()
+
+	for emitter, view := range after {
+		prev, ok := before[emitter]
+		if !ok {
+			continue // connected meanwhile, PushState covers it
+		}
+		for _, msg := range s.viewEvents(prev, view) {
+			emitter.Post(msg)
+		}
+	}
+}